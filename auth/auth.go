@@ -0,0 +1,72 @@
+// Package auth is a reference duplex.ClientInterceptor /
+// duplex.ServerInterceptor pair that authenticates calls with a
+// shared-secret HMAC, demonstrating duplex's middleware API (see
+// duplex.Peer.Use and duplex.Peer.UseServer).
+//
+// ClientInterceptor signs a call's method name with the shared secret
+// and appends the signature to it; ServerInterceptor verifies the
+// signature and strips it back off before the real method lookup runs,
+// rejecting the call with ErrUnauthorized if it's missing or wrong.
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/lessc0de/duplex"
+)
+
+// verify reports whether sig is the hex-encoded HMAC of method under
+// secret, comparing in constant time so a failed check can't leak how
+// many leading bytes were correct.
+func verify(secret []byte, method, sig string) bool {
+	want, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method))
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// sigSep separates a signed method name from its signature on the wire,
+// e.g. "Arith.Add#3a5f...".
+const sigSep = "#"
+
+// ErrUnauthorized is the error ServerInterceptor reports back to the
+// caller when a call's signature is missing or doesn't match.
+var ErrUnauthorized = errors.New("auth: invalid signature")
+
+func sign(secret []byte, method string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ClientInterceptor returns a duplex.ClientInterceptor that signs every
+// call's method name with secret. Register it with a Peer's Use.
+func ClientInterceptor(secret []byte) duplex.ClientInterceptor {
+	return func(ctx context.Context, method string, in, out interface{}, next duplex.ClientHandler) (*duplex.Call, error) {
+		signed := method + sigSep + sign(secret, method)
+		return next(ctx, signed, in, out)
+	}
+}
+
+// ServerInterceptor returns a duplex.ServerInterceptor that verifies the
+// signature ClientInterceptor attaches to every call, rejecting it with
+// ErrUnauthorized if the signature is missing or was computed with a
+// different secret. Register it with a Peer's UseServer.
+func ServerInterceptor(secret []byte) duplex.ServerInterceptor {
+	return func(ctx context.Context, method string, ch *duplex.Channel, next duplex.ServerHandler) {
+		unsigned, sig, ok := strings.Cut(method, sigSep)
+		if !ok || !verify(secret, unsigned, sig) {
+			ch.SendError(ErrUnauthorized)
+			return
+		}
+		next(ctx, unsigned, ch)
+	}
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/lessc0de/duplex"
+)
+
+type args struct {
+	A, B int
+}
+
+type reply struct {
+	C int
+}
+
+type arith int
+
+func (arith) Add(a args, r *reply) error {
+	r.C = a.A + a.B
+	return nil
+}
+
+func TestCallSucceedsWithMatchingSecret(t *testing.T) {
+	secret := []byte("shared-secret")
+
+	server := duplex.NewPeer()
+	if err := server.Bind("127.0.0.1:19881"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.UseServer(ServerInterceptor(secret))
+	server.Register(new(arith))
+	go server.Serve()
+
+	client := duplex.NewPeer()
+	if err := client.Connect("127.0.0.1:19881"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Use(ClientInterceptor(secret))
+
+	reply := new(reply)
+	if err := client.Call("arith.Add", args{1, 2}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.C != 3 {
+		t.Fatalf("got %d, want 3", reply.C)
+	}
+}
+
+func TestCallRejectedWithWrongSecret(t *testing.T) {
+	server := duplex.NewPeer()
+	if err := server.Bind("127.0.0.1:19882"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.UseServer(ServerInterceptor([]byte("server-secret")))
+	server.Register(new(arith))
+	go server.Serve()
+
+	client := duplex.NewPeer()
+	if err := client.Connect("127.0.0.1:19882"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Use(ClientInterceptor([]byte("wrong-secret")))
+
+	// A rejected call crosses the wire as a plain frameError, which only
+	// preserves the message, not ErrUnauthorized's identity.
+	reply := new(reply)
+	err := client.Call("arith.Add", args{1, 2}, reply)
+	if err == nil || err.Error() != ErrUnauthorized.Error() {
+		t.Fatalf("expected %q, got %v", ErrUnauthorized, err)
+	}
+}
+
+func TestCallRejectedWithNoSignature(t *testing.T) {
+	server := duplex.NewPeer()
+	if err := server.Bind("127.0.0.1:19883"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.UseServer(ServerInterceptor([]byte("server-secret")))
+	server.Register(new(arith))
+	go server.Serve()
+
+	client := duplex.NewPeer()
+	if err := client.Connect("127.0.0.1:19883"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// A rejected call crosses the wire as a plain frameError, which only
+	// preserves the message, not ErrUnauthorized's identity.
+	reply := new(reply)
+	err := client.Call("arith.Add", args{1, 2}, reply)
+	if err == nil || err.Error() != ErrUnauthorized.Error() {
+		t.Fatalf("expected %q, got %v", ErrUnauthorized, err)
+	}
+}
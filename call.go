@@ -0,0 +1,263 @@
+package duplex
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"runtime"
+)
+
+// Call represents an in-flight or completed RPC started with Open.
+type Call struct {
+	Method string
+	Error  error
+	Done   chan struct{}
+}
+
+// CallOption configures a single Call/CallContext/Open/OpenContext
+// invocation.
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	retries int
+}
+
+// WithRetry makes a call retry up to n additional times, each time
+// asking the Peer's Selector for a different Endpoint, if the one it
+// was using fails with ErrConnLost. It has no effect on a Peer with
+// only one Endpoint, or whose Selector keeps returning the same one.
+//
+// A retried streaming call restarts the method from scratch on the new
+// Endpoint rather than resuming it, so a handler whose replies aren't
+// idempotent may be re-invoked and its earlier replies re-delivered to
+// out; this still satisfies the caller never seeing an error, but not
+// exactly-once delivery.
+func WithRetry(n int) CallOption {
+	return func(o *callOptions) { o.retries = n }
+}
+
+// Call invokes the named method, waits for it to complete, and stores
+// the result in reply. It is a convenience wrapper around Open that
+// blocks until the call is Done.
+func (p *Peer) Call(method string, args interface{}, reply interface{}, opts ...CallOption) error {
+	call, err := p.Open(method, args, reply, opts...)
+	if err != nil {
+		return err
+	}
+	<-call.Done
+	return call.Error
+}
+
+// CallContext is Call, except that canceling ctx (including its deadline
+// expiring) aborts the call: the underlying channel is sent a CANCEL
+// frame and call.Error becomes ctx.Err() rather than waiting for a
+// reply that may never come.
+func (p *Peer) CallContext(ctx context.Context, method string, args interface{}, reply interface{}, opts ...CallOption) error {
+	call, err := p.OpenContext(ctx, method, args, reply, opts...)
+	if err != nil {
+		return err
+	}
+	<-call.Done
+	return call.Error
+}
+
+// Open starts a call to the named method, choosing an Endpoint with the
+// Peer's Selector (see SetSelector). in supplies the call's input:
+// either a plain value, sent once, or a *SendStream that the caller
+// populates over time with Send/SendLast -- a *SendStream input cannot
+// be retried, since the caller already holds a reference to it once
+// Open returns. out receives the call's output: either a pointer to a
+// single reply value or a channel that receives every streamed reply.
+func (p *Peer) Open(method string, in interface{}, out interface{}, opts ...CallOption) (*Call, error) {
+	return p.OpenContext(context.Background(), method, in, out, opts...)
+}
+
+// OpenContext is Open, except that canceling ctx sends a CANCEL frame
+// for the call's channel and finishes it locally with ctx.Err() -- see
+// CallContext. A handler registered with a leading context.Context
+// parameter observes the same cancellation on the server side.
+//
+// Every call a Peer makes -- from Call, CallContext, Open, and
+// OpenContext alike -- funnels through here, so this is also where a
+// Peer's ClientInterceptor chain (see Use) runs, wrapping every retry
+// WithRetry causes as a single call.
+func (p *Peer) OpenContext(ctx context.Context, method string, in interface{}, out interface{}, opts ...CallOption) (*Call, error) {
+	var co callOptions
+	for _, opt := range opts {
+		opt(&co)
+	}
+	terminal := func(ctx context.Context, method string, in, out interface{}) (*Call, error) {
+		return p.openContext(ctx, method, in, out, co.retries)
+	}
+	h := chainClient(p.clientInterceptors, terminal)
+	return h(ctx, method, in, out)
+}
+
+func (p *Peer) openContext(ctx context.Context, method string, in interface{}, out interface{}, retries int) (*Call, error) {
+	sess, ep, err := p.selectSession(method, in)
+	if err != nil {
+		return nil, err
+	}
+	ch := sess.newLocalChannel()
+	ch.watchContext(ctx)
+	if err := sendInput(sess, ch, method, in); err != nil {
+		return nil, err
+	}
+
+	call := &Call{Method: method, Done: make(chan struct{})}
+	go p.runAttempts(ctx, method, in, out, call, ch, ep, retries)
+	return call, nil
+}
+
+// selectSession asks the Peer's Selector (if any) for the Endpoint an
+// outgoing call to method should use. A Peer with no Selector installed
+// -- which NewPeer never produces, but a zero-value Peer built by hand
+// could -- falls back to its first session, matching the pre-Selector
+// behavior.
+func (p *Peer) selectSession(method string, args interface{}) (*session, *Endpoint, error) {
+	p.mu.Lock()
+	sel := p.selector
+	p.mu.Unlock()
+	if sel == nil {
+		sess := p.anySession()
+		if sess == nil {
+			return nil, nil, ErrNoConnection
+		}
+		return sess, nil, nil
+	}
+	ep, err := sel.Select(method, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ep.sess, ep, nil
+}
+
+func (p *Peer) reportSelector(ep *Endpoint, err error) {
+	if ep == nil {
+		return
+	}
+	p.mu.Lock()
+	sel := p.selector
+	p.mu.Unlock()
+	if sel != nil {
+		sel.Report(ep, err)
+	}
+}
+
+// sendInput writes method's input onto ch, either as a one-shot value
+// followed by a close or, for a *SendStream, by handing the channel to
+// the caller to populate over time.
+func sendInput(sess *session, ch *Channel, method string, in interface{}) error {
+	if ss, ok := in.(*SendStream); ok {
+		if err := sess.writeFrame(&frame{id: ch.id, typ: frameOpen, method: method}); err != nil {
+			return err
+		}
+		ss.ch = ch
+		return nil
+	}
+	payload, err := encodeValue(sess.peer.codec, in)
+	if err != nil {
+		return err
+	}
+	if err := sess.writeFrame(&frame{id: ch.id, typ: frameOpen, method: method, payload: payload}); err != nil {
+		return err
+	}
+	return ch.sendClose()
+}
+
+// runAttempts drains ch into out, retrying on a freshly selected
+// Endpoint up to retries times if the attempt fails with ErrConnLost --
+// the error session.readLoop's defer reports when a connection drops
+// out from under an in-flight call, as opposed to the peer finishing
+// the call normally. A *SendStream input is never retried: ch is
+// already in the caller's hands by the time this runs, so a second
+// attempt would need a second channel the caller has no way to learn
+// about.
+func (p *Peer) runAttempts(ctx context.Context, method string, in, out interface{}, call *Call, ch *Channel, ep *Endpoint, retries int) {
+	defer close(call.Done)
+	outVal := reflect.ValueOf(out)
+	streaming := outVal.Kind() == reflect.Chan
+	canRetry := true
+	if _, ok := in.(*SendStream); ok {
+		canRetry = false
+	}
+
+	var finalErr error
+	for {
+		attemptErr := deliverAttempt(ch, outVal, streaming, out)
+		p.reportSelector(ep, attemptErr)
+		if attemptErr == nil {
+			finalErr = nil
+			break
+		}
+		if canRetry && retries > 0 && errors.Is(attemptErr, ErrConnLost) {
+			retries--
+			var sess *session
+			var selErr error
+			sess, ep, selErr = p.selectSession(method, in)
+			if selErr != nil {
+				finalErr = attemptErr
+				break
+			}
+			ch = sess.newLocalChannel()
+			ch.watchContext(ctx)
+			if err := sendInput(sess, ch, method, in); err != nil {
+				finalErr = err
+				break
+			}
+			continue
+		}
+		finalErr = attemptErr
+		break
+	}
+
+	// call.Error must be written before outVal is closed: a caller
+	// ranging over out only learns call is finished by observing the
+	// close, and closing a channel happens before a receive that
+	// returns because of it, so this ordering is what makes call.Error
+	// visible without a data race once the range loop ends.
+	call.Error = finalErr
+	if streaming {
+		outVal.Close()
+		// Don't mark the call Done until the caller's own goroutine has
+		// drained the channel we just closed -- otherwise a buffered
+		// out chan lets Done fire before the caller ever sees the last
+		// few messages it's racing to read.
+		for outVal.Len() > 0 {
+			runtime.Gosched()
+		}
+	}
+}
+
+// deliverAttempt drains one attempt's channel into out, returning nil
+// once the peer closes it normally (io.EOF) or the error it reported.
+func deliverAttempt(ch *Channel, outVal reflect.Value, streaming bool, out interface{}) error {
+	if !streaming {
+		for {
+			err := ch.Receive(out)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	elemType := outVal.Type().Elem()
+	for {
+		msgv := reflect.New(deref(elemType))
+		err := ch.Receive(msgv.Interface())
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if elemType.Kind() == reflect.Ptr {
+			outVal.Send(msgv)
+		} else {
+			outVal.Send(msgv.Elem())
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package duplex
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrWouldBlock is returned by Channel.TrySend when sending would have
+// to wait for flow-control credit.
+var ErrWouldBlock = errors.New("duplex: send would block")
+
+// Channel is a bidirectional, framed message stream scoped to one call.
+// Either side may Send messages on it and Receive messages the other
+// side has sent; Receive returns io.EOF once the peer has finished
+// sending, or the error the peer reported.
+//
+// Sends are flow-controlled: a Channel will not put more unacknowledged
+// bytes on the wire than its sendWindow allows, and the owning session
+// enforces a combined cap across all of its channels. The window starts
+// at the owning Peer's configured size (see WithWindowSize) and is
+// replenished by WINDOW_UPDATE frames the receiver emits as it drains
+// its buffer in Receive.
+type Channel struct {
+	id   uint64
+	sess *session
+
+	mu sync.Mutex
+	// recv carries decoded frameData payloads to Receive. It is never
+	// closed -- deliver/apply run on a different goroutine than Receive,
+	// and closing a channel a concurrent send might still land on
+	// panics -- Receive instead learns the channel is finished from
+	// closeSignal (see finish).
+	recv        chan []byte
+	closeSignal chan struct{}
+	closed      bool // peer is done sending (remote direction finished)
+	err         error
+	localDone   bool // we are done sending (local direction finished)
+
+	// queueMu/queueCond guard queue, the frames deliver has queued for
+	// dispatchLoop to apply. deliver only ever appends to queue, never
+	// blocking on it, so a Channel whose consumer has stopped calling
+	// Receive backs up only its own queue, not every other channel
+	// multiplexed on the same session (see deliver). It can only grow as
+	// large as the peer on the other end's own sendWindow lets it push
+	// without a WINDOW_UPDATE, since Receive is what emits those.
+	queueMu   sync.Mutex
+	queueCond *sync.Cond
+	queue     []*frame
+
+	// sendWindow is the number of bytes this side may still put on the
+	// wire before waiting for credit. Guarded by sess.capMu, not mu,
+	// since acquiring it also has to check the session-wide cap.
+	sendWindow int
+
+	// outstanding is how much of sess.pendingTotal this channel is
+	// currently responsible for: bytes acquireWindow has counted against
+	// the session-wide cap that no WINDOW_UPDATE has credited back yet.
+	// A channel that finishes with outstanding > 0 -- canceled, errored,
+	// or just never drained by its peer -- has that contribution released
+	// back to sess.pendingTotal once (see the ctx-done goroutine in
+	// newChannel), since no further WINDOW_UPDATE for it will ever arrive.
+	// Guarded by sess.capMu, same as sendWindow.
+	outstanding int
+
+	// ctx is this channel's lifetime: it is canceled the moment the
+	// channel finishes, for any reason (peer closed or errored it, a
+	// CANCEL frame arrived, or the session went down), and is the
+	// context.Context a handler registered with a leading ctx parameter
+	// receives. watchContext links it to a caller-supplied ctx on the
+	// Open/Call side.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newChannel(id uint64, sess *session) *Channel {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Channel{
+		id:          id,
+		sess:        sess,
+		recv:        make(chan []byte, 64),
+		closeSignal: make(chan struct{}),
+		sendWindow:  sess.peer.initialWindow,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	c.queueCond = sync.NewCond(&c.queueMu)
+	// Wake anything blocked in acquireWindow, or dispatchLoop once its
+	// queue is empty, as soon as the channel's context is done, so a
+	// canceled Send or a finished channel with nothing left to apply
+	// doesn't wait around for either.
+	go func() {
+		<-ctx.Done()
+		sess.capMu.Lock()
+		sess.pendingTotal -= c.outstanding
+		if sess.pendingTotal < 0 {
+			sess.pendingTotal = 0
+		}
+		c.outstanding = 0
+		sess.capCond.Broadcast()
+		sess.capMu.Unlock()
+		c.queueMu.Lock()
+		c.queueCond.Broadcast()
+		c.queueMu.Unlock()
+	}()
+	go c.dispatchLoop()
+	return c
+}
+
+// dispatchLoop applies frames deliver has queued for this channel, one at
+// a time and in the order they arrived, until the queue is empty and the
+// channel's context is done. Running this off of the session's read loop
+// is what lets a consumer that has stopped calling Receive block only
+// its own channel (apply's send to recv blocks, queue keeps growing)
+// rather than every other channel multiplexed on the same session.
+func (c *Channel) dispatchLoop() {
+	for {
+		c.queueMu.Lock()
+		for len(c.queue) == 0 && c.ctx.Err() == nil {
+			c.queueCond.Wait()
+		}
+		if len(c.queue) == 0 {
+			c.queueMu.Unlock()
+			return
+		}
+		f := c.queue[0]
+		c.queue = c.queue[1:]
+		c.queueMu.Unlock()
+		c.apply(f)
+	}
+}
+
+// watchContext ties ctx to the channel: once ctx is done, a CANCEL frame
+// naming the reason is sent to the peer and the channel finishes locally
+// with ctx.Err(), without waiting for any reply. It is a no-op for a ctx
+// that can never be canceled, so Open/Call's ordinary path (which passes
+// context.Background()) pays nothing for it.
+func (c *Channel) watchContext(ctx context.Context) {
+	if ctx.Done() == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			reason := cancelCanceled
+			if ctx.Err() == context.DeadlineExceeded {
+				reason = cancelDeadlineExceeded
+			}
+			c.sess.writeFrame(&frame{id: c.id, typ: frameCancel, payload: []byte{byte(reason)}})
+			c.finish(ctx.Err())
+		case <-c.ctx.Done():
+			// The channel already finished on its own; nothing to do.
+		}
+	}()
+}
+
+// Send encodes msg and writes it to the channel, blocking until enough
+// flow-control credit is available.
+func (c *Channel) Send(msg interface{}) error {
+	payload, err := encodeValue(c.sess.peer.codec, msg)
+	if err != nil {
+		return err
+	}
+	if err := c.acquireWindow(len(payload), true); err != nil {
+		return err
+	}
+	return c.sess.writeFrame(&frame{id: c.id, typ: frameData, payload: payload})
+}
+
+// TrySend behaves like Send but returns ErrWouldBlock immediately
+// instead of waiting for flow-control credit to become available.
+func (c *Channel) TrySend(msg interface{}) error {
+	payload, err := encodeValue(c.sess.peer.codec, msg)
+	if err != nil {
+		return err
+	}
+	if err := c.acquireWindow(len(payload), false); err != nil {
+		return err
+	}
+	return c.sess.writeFrame(&frame{id: c.id, typ: frameData, payload: payload})
+}
+
+// acquireWindow reserves n bytes of this channel's send window and the
+// session's overall pending-bytes cap, blocking (if block is true) until
+// both are available.
+func (c *Channel) acquireWindow(n int, block bool) error {
+	s := c.sess
+	s.capMu.Lock()
+	defer s.capMu.Unlock()
+	for {
+		if err := c.ctx.Err(); err != nil {
+			// Report why the channel finished (ErrShutdown, ErrConnLost, a
+			// peer's error or CANCEL) rather than the bare context error.
+			c.mu.Lock()
+			if c.err != nil {
+				err = c.err
+			}
+			c.mu.Unlock()
+			return err
+		}
+		capOK := s.maxPendingBytes == 0 || s.pendingTotal+n <= s.maxPendingBytes
+		if n <= c.sendWindow && capOK {
+			c.sendWindow -= n
+			s.pendingTotal += n
+			c.outstanding += n
+			return nil
+		}
+		if !block {
+			return ErrWouldBlock
+		}
+		s.capCond.Wait()
+	}
+}
+
+// sendClose signals that this side is done sending on the channel.
+func (c *Channel) sendClose() error {
+	err := c.sess.writeFrame(&frame{id: c.id, typ: frameClose})
+	c.markLocalDone()
+	return err
+}
+
+// sendError signals that this side failed with err and is done sending.
+func (c *Channel) sendError(err error) error {
+	werr := c.sess.writeFrame(&frame{id: c.id, typ: frameError, payload: []byte(err.Error())})
+	c.markLocalDone()
+	return werr
+}
+
+// SendError aborts the channel by reporting err to the peer as the
+// reason this side is done, the same as a modeChannel handler returning
+// err. A ServerInterceptor that rejects a call -- a failed auth check,
+// say -- calls this instead of continuing the chain.
+func (c *Channel) SendError(err error) error {
+	return c.sendError(err)
+}
+
+// markLocalDone records that this side has finished sending and, if the
+// peer had already finished too, drops the channel from the session's
+// routing table. Closing one direction must not do this on its own: a
+// channel whose peer closed first (as happens whenever Open's input is a
+// single value rather than a SendStream) still needs to route the
+// WINDOW_UPDATE and data frames that flow the other way.
+func (c *Channel) markLocalDone() {
+	c.mu.Lock()
+	c.localDone = true
+	bothDone := c.closed
+	c.mu.Unlock()
+	if bothDone {
+		c.cancel()
+		c.sess.forget(c.id)
+	}
+}
+
+// Receive decodes the next message the peer sent into msg and emits a
+// WINDOW_UPDATE crediting the peer's sender with the bytes just
+// consumed. It returns io.EOF once the peer has closed its side of the
+// channel, or any error the peer reported.
+func (c *Channel) Receive(msg interface{}) error {
+	// Drain anything already buffered before considering closeSignal, so
+	// a channel that finished with messages still sitting in recv
+	// delivers all of them before Receive starts reporting EOF/err.
+	select {
+	case payload := <-c.recv:
+		return c.decodeAndCredit(payload, msg)
+	default:
+	}
+	select {
+	case payload := <-c.recv:
+		return c.decodeAndCredit(payload, msg)
+	case <-c.closeSignal:
+		c.mu.Lock()
+		err := c.err
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		return io.EOF
+	}
+}
+
+func (c *Channel) decodeAndCredit(payload []byte, msg interface{}) error {
+	if err := decodeValue(c.sess.peer.codec, payload, msg); err != nil {
+		return err
+	}
+	return c.sess.writeFrame(&frame{id: c.id, typ: frameWindowUpdate, payload: encodeUint32(len(payload))})
+}
+
+// deliver is called by the session read loop with each frame addressed
+// to this channel. WINDOW_UPDATE is applied immediately, since doing so
+// never blocks; everything else is queued for dispatchLoop to apply
+// instead of handled inline here -- and deliver never blocks queuing it,
+// so a channel whose consumer has stopped draining Receive can't stall
+// frames the read loop owes to every other channel multiplexed on the
+// same session.
+func (c *Channel) deliver(f *frame) {
+	if f.typ == frameWindowUpdate {
+		delta := decodeUint32(f.payload)
+		s := c.sess
+		s.capMu.Lock()
+		c.sendWindow += delta
+		s.pendingTotal -= delta
+		c.outstanding -= delta
+		if s.pendingTotal < 0 {
+			s.pendingTotal = 0
+		}
+		s.capMu.Unlock()
+		s.capCond.Broadcast()
+		return
+	}
+	c.queueMu.Lock()
+	c.queue = append(c.queue, f)
+	c.queueMu.Unlock()
+	c.queueCond.Signal()
+}
+
+// apply is dispatchLoop's per-frame handler for everything deliver
+// queues instead of applying inline.
+func (c *Channel) apply(f *frame) {
+	switch f.typ {
+	case frameData:
+		select {
+		case c.recv <- f.payload:
+		case <-c.closeSignal:
+		}
+	case frameClose:
+		c.finish(nil)
+	case frameError:
+		c.finish(errors.New(string(f.payload)))
+	case frameCancel:
+		err := context.Canceled
+		if len(f.payload) > 0 && cancelReason(f.payload[0]) == cancelDeadlineExceeded {
+			err = context.DeadlineExceeded
+		}
+		c.finish(err)
+	}
+}
+
+func (c *Channel) finish(err error) {
+	c.mu.Lock()
+	firstClose := !c.closed
+	c.closed = true
+	// A stream-out call's peer direction is typically finished (a plain
+	// frameClose, err == nil) long before the call itself is: only the
+	// first non-nil err gets to set c.err and tear down ctx, so a CANCEL
+	// or error that arrives afterwards still takes effect instead of
+	// being swallowed by the firstClose guard below.
+	recordErr := err != nil && c.err == nil
+	if recordErr {
+		c.err = err
+	}
+	bothDone := c.localDone
+	c.mu.Unlock()
+	if recordErr || (firstClose && bothDone) {
+		c.cancel()
+	}
+	if firstClose {
+		close(c.closeSignal)
+	}
+	if firstClose && bothDone {
+		c.sess.forget(c.id)
+	}
+}
+
+// SendStream is a write-only view of a Channel used when a call's input
+// or output is a simple stream of messages rather than a single value.
+// As a handler parameter it is the stream of replies a server method
+// sends back to the caller; as an Open argument, the caller populates it
+// with Send/SendLast as the call progresses.
+type SendStream struct {
+	ch *Channel
+}
+
+// Send writes msg to the stream, blocking for flow-control credit if
+// necessary.
+func (s *SendStream) Send(msg interface{}) error {
+	if s.ch == nil {
+		return errors.New("duplex: stream is not open")
+	}
+	return s.ch.Send(msg)
+}
+
+// SendLast writes msg to the stream and signals that no further messages
+// will follow.
+func (s *SendStream) SendLast(msg interface{}) error {
+	if s.ch == nil {
+		return errors.New("duplex: stream is not open")
+	}
+	if err := s.ch.Send(msg); err != nil {
+		return err
+	}
+	return s.ch.sendClose()
+}
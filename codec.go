@@ -0,0 +1,33 @@
+package duplex
+
+import (
+	"encoding/gob"
+	"io"
+)
+
+// Codec translates call arguments and stream messages to and from bytes
+// on the wire. The default is gob; duplex/jsoncodec and duplex/protocodec
+// provide plain JSON and protobuf alternatives. Peers negotiate their
+// Codec during the connection handshake (see WithCodec) and refuse to
+// talk to a peer using a different one.
+type Codec interface {
+	// Name identifies the codec during the handshake. Two peers with
+	// different Name()s fail the handshake rather than risk silently
+	// misinterpreting each other's frames.
+	Name() string
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+// gobCodec is the default Codec, matching duplex's original wire format.
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Encode(w io.Writer, v interface{}) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+func (gobCodec) Decode(r io.Reader, v interface{}) error {
+	return gob.NewDecoder(r).Decode(v)
+}
@@ -0,0 +1,286 @@
+// Package duplex implements a bidirectional RPC protocol on top of a
+// single connection. Unlike net/rpc, a connection is not split into a
+// fixed client end and server end: either Peer may Register services to
+// handle incoming calls and either may issue calls of its own with Call
+// or Open, all multiplexed over the same session.
+package duplex
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// defaultWindowSize is the per-channel flow-control window used when a
+// Peer is not given WithWindowSize.
+const defaultWindowSize = 256 * 1024
+
+// ErrShutdown is returned by pending calls and blocked sends when the
+// owning Peer is closed.
+var ErrShutdown = errors.New("duplex: peer is shut down")
+
+// ErrNoConnection is returned by Call/Open when the Peer has no session
+// to issue the request on.
+var ErrNoConnection = errors.New("duplex: peer has no connection")
+
+// ErrConnLost is the error an in-flight call's Receive/Send/Call/Open
+// reports when its session's connection failed while the call was still
+// outstanding. Combined with WithRetry, a Peer with more than one
+// connected endpoint retries the call on another one its Selector picks.
+var ErrConnLost = errors.New("duplex: connection lost")
+
+// Option configures a Peer at construction time.
+type Option func(*Peer)
+
+// WithWindowSize sets the per-channel flow-control window: the number of
+// unacknowledged bytes a sender may have in flight on one channel before
+// it must wait for a WINDOW_UPDATE from the peer.
+func WithWindowSize(n int) Option {
+	return func(p *Peer) { p.initialWindow = n }
+}
+
+// WithMaxPendingBytes caps the total unacknowledged bytes a session may
+// have in flight across all of its channels, so that one stalled channel
+// cannot by itself exhaust process memory. Zero (the default) leaves the
+// total unbounded; per-channel windows still apply.
+func WithMaxPendingBytes(n int) Option {
+	return func(p *Peer) { p.maxPendingBytes = n }
+}
+
+// WithCodec sets the Codec a Peer uses to encode and decode call
+// arguments and stream messages. The default is gob. Peers negotiate
+// their Codec when a session is established; a peer configured with a
+// different Codec fails the connection rather than risk misinterpreting
+// frames.
+func WithCodec(c Codec) Option {
+	return func(p *Peer) { p.codec = c }
+}
+
+// Peer is one endpoint of zero or more duplex sessions. A Peer can
+// accept connections (Bind), dial out (Connect) -- repeatedly, to build
+// up a pool of endpoints a Selector load-balances across -- register
+// services to handle incoming calls (Register), and issue calls of its
+// own (Call, Open) -- all on the same set of underlying connections.
+type Peer struct {
+	mu        sync.Mutex
+	sessions  []*session
+	endpoints []*Endpoint
+	services  map[string]*service
+	listener  net.Listener
+	openCh    chan dispatchRequest
+	closed    bool
+	done      chan struct{}
+
+	initialWindow   int
+	maxPendingBytes int
+	codec           Codec
+
+	clientInterceptors []ClientInterceptor
+	serverInterceptors []ServerInterceptor
+	selector           Selector
+
+	subs           []*subscription
+	localTopicRefs map[string]int
+	remoteInterest map[*session]map[string]bool
+	nextPublishID  uint64
+	pendingAcks    map[uint64]*pendingAck
+}
+
+// NewPeer creates a Peer with no active connections.
+func NewPeer(opts ...Option) *Peer {
+	p := &Peer{
+		services:       make(map[string]*service),
+		openCh:         make(chan dispatchRequest, 64),
+		done:           make(chan struct{}),
+		initialWindow:  defaultWindowSize,
+		codec:          gobCodec{},
+		selector:       NewRoundRobinSelector(),
+		localTopicRefs: make(map[string]int),
+		remoteInterest: make(map[*session]map[string]bool),
+		pendingAcks:    make(map[uint64]*pendingAck),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Bind listens on addr and adds a session for every connection accepted.
+func (p *Peer) Bind(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.listener = ln
+	p.mu.Unlock()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// A codec mismatch has no caller to report to on this side;
+			// the fast-failing half of the contract is Connect's.
+			p.addSession(conn, false, conn.RemoteAddr().String())
+		}
+	}()
+	return nil
+}
+
+// Connect dials addr and adds the resulting connection as an endpoint a
+// Peer's Selector can choose among. It fails fast if the peer at addr
+// negotiates a different Codec. Calling Connect more than once builds up
+// a pool of endpoints for load balancing or failover; see SetSelector
+// and WithRetry.
+func (p *Peer) Connect(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	_, err = p.addSession(conn, true, addr)
+	return err
+}
+
+func (p *Peer) addSession(conn net.Conn, dialed bool, addr string) (*session, error) {
+	if dialed {
+		if err := dialHandshake(conn, p.codec.Name()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	} else if err := sendHello(conn, p.codec.Name()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sess := newSession(conn, p, dialed)
+	ep := &Endpoint{Addr: addr, sess: sess}
+	p.mu.Lock()
+	p.sessions = append(p.sessions, sess)
+	p.endpoints = append(p.endpoints, ep)
+	sel, snapshot := p.selector, p.endpointsLocked()
+	topics := make([]string, 0, len(p.localTopicRefs))
+	for topic := range p.localTopicRefs {
+		topics = append(topics, topic)
+	}
+	p.mu.Unlock()
+	if sel != nil {
+		sel.Endpoints(snapshot)
+	}
+	// Tell the new session about every topic we're already subscribed
+	// to, the same announcement Subscribe makes to sessions that exist
+	// at the time it's called.
+	for _, topic := range topics {
+		sess.writeFrame(&frame{typ: frameSubscribe, method: topic})
+	}
+	go sess.readLoop()
+	return sess, nil
+}
+
+func (p *Peer) anySession() *session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.sessions) == 0 {
+		return nil
+	}
+	return p.sessions[0]
+}
+
+// dropSession removes sess from the Peer's pool of endpoints once its
+// connection is gone and tells the Selector the pool has changed, so a
+// retried call (see WithRetry) never lands back on it.
+func (p *Peer) dropSession(sess *session) {
+	p.mu.Lock()
+	for i, s := range p.sessions {
+		if s == sess {
+			p.sessions = append(p.sessions[:i], p.sessions[i+1:]...)
+			break
+		}
+	}
+	for i, ep := range p.endpoints {
+		if ep.sess == sess {
+			p.endpoints = append(p.endpoints[:i], p.endpoints[i+1:]...)
+			break
+		}
+	}
+	delete(p.remoteInterest, sess)
+	// A Publish waiting on an ack from sess would otherwise wait
+	// forever now that it's gone.
+	var completed []*pendingAck
+	for id, pending := range p.pendingAcks {
+		if !pending.remaining[sess] {
+			continue
+		}
+		delete(pending.remaining, sess)
+		if len(pending.remaining) == 0 {
+			completed = append(completed, pending)
+			delete(p.pendingAcks, id)
+		}
+	}
+	sel, snapshot := p.selector, p.endpointsLocked()
+	p.mu.Unlock()
+	if sel != nil {
+		sel.Endpoints(snapshot)
+	}
+	for _, pending := range completed {
+		close(pending.done)
+	}
+}
+
+// endpointsLocked returns a copy of p.endpoints safe to hand to a
+// Selector outside of p.mu. Callers must hold p.mu.
+func (p *Peer) endpointsLocked() []*Endpoint {
+	return append([]*Endpoint(nil), p.endpoints...)
+}
+
+// SetSelector installs the Selector a Peer's Call and Open use to choose
+// among its connected endpoints. The default is a RoundRobinSelector. A
+// nil Selector falls back to the pre-Selector behavior of always using
+// the first connected session.
+func (p *Peer) SetSelector(s Selector) {
+	p.mu.Lock()
+	p.selector = s
+	snapshot := p.endpointsLocked()
+	p.mu.Unlock()
+	if s != nil {
+		s.Endpoints(snapshot)
+	}
+}
+
+// Close shuts down every session and stops accepting new connections.
+func (p *Peer) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	ln := p.listener
+	sessions := p.sessions
+	p.mu.Unlock()
+
+	close(p.done)
+	if ln != nil {
+		ln.Close()
+	}
+	for _, s := range sessions {
+		s.close(ErrShutdown)
+	}
+	return nil
+}
+
+// Serve dispatches incoming calls to registered services until the Peer
+// is closed. Any Peer that has Register'd services must run Serve,
+// typically in its own goroutine.
+func (p *Peer) Serve() {
+	for {
+		select {
+		case req, ok := <-p.openCh:
+			if !ok {
+				return
+			}
+			go p.dispatch(req)
+		case <-p.done:
+			return
+		}
+	}
+}
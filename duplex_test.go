@@ -1,13 +1,37 @@
 package duplex
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/lessc0de/duplex/jsoncodec"
 )
 
+// codecsUnderTest is the set of Codecs the core call/stream tests run
+// against, so a codec's wire format can't silently break anything gob
+// happens to tolerate. protocodec is exercised separately (see
+// protocodec's own tests) since it only accepts proto.Message values,
+// which Args/StreamingArgs and friends below are not.
+var codecsUnderTest = []Codec{gobCodec{}, jsoncodec.Codec{}}
+
+// withEachCodec runs fn once per entry in codecsUnderTest, as a subtest
+// named after the codec.
+func withEachCodec(t *testing.T, fn func(t *testing.T, codec Codec)) {
+	for _, codec := range codecsUnderTest {
+		codec := codec
+		t.Run(codec.Name(), func(t *testing.T) {
+			fn(t, codec)
+		})
+	}
+}
+
 type Args struct {
 	A, B int
 }
@@ -56,31 +80,39 @@ func (t *Arith) TakesContext(context *string, args string, reply *string) error
 	return nil
 }
 
+func (t *Arith) Slow(args Args, reply *Reply) error {
+	time.Sleep(200 * time.Millisecond)
+	reply.C = args.A + args.B
+	return nil
+}
+
 func TestSimpleCall(t *testing.T) {
-	client := NewPeer()
-	if err := client.Bind("127.0.0.1:9876"); err != nil {
-		t.Fatal(err)
-	}
-	defer client.Close()
-	server := NewPeer()
-	if err := server.Connect("127.0.0.1:9876"); err != nil {
-		t.Fatal(err)
-	}
-	defer server.Close()
+	withEachCodec(t, func(t *testing.T, codec Codec) {
+		client := NewPeer(WithCodec(codec))
+		if err := client.Bind("127.0.0.1:9876"); err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		server := NewPeer(WithCodec(codec))
+		if err := server.Connect("127.0.0.1:9876"); err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
 
-	server.Register(new(Arith))
-	go server.Serve()
+		server.Register(new(Arith))
+		go server.Serve()
 
-	// Synchronous calls
-	args := &Args{7, 8}
-	reply := new(Reply)
-	err := client.Call("Arith.Add", args, reply)
-	if err != nil {
-		t.Errorf("Add: expected no error but got string %q", err.Error())
-	}
-	if reply.C != args.A+args.B {
-		t.Errorf("Add: expected %d got %d", reply.C, args.A+args.B)
-	}
+		// Synchronous calls
+		args := &Args{7, 8}
+		reply := new(Reply)
+		err := client.Call("Arith.Add", args, reply)
+		if err != nil {
+			t.Errorf("Add: expected no error but got string %q", err.Error())
+		}
+		if reply.C != args.A+args.B {
+			t.Errorf("Add: expected %d got %d", args.A+args.B, reply.C)
+		}
+	})
 }
 
 type StreamingArgs struct {
@@ -144,130 +176,950 @@ func (t *StreamingArith) Echo(channel *Channel) error {
 }
 
 func TestStreamingOutput(t *testing.T) {
-	client := NewPeer()
-	if err := client.Bind("127.0.0.1:9876"); err != nil {
+	withEachCodec(t, func(t *testing.T, codec Codec) {
+		client := NewPeer(WithCodec(codec))
+		if err := client.Bind("127.0.0.1:9876"); err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		server := NewPeer(WithCodec(codec))
+		if err := server.Connect("127.0.0.1:9876"); err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+
+		server.Register(new(StreamingArith))
+		go server.Serve()
+
+		args := &StreamingArgs{3, 5, -1}
+		replyChan := make(chan *StreamingReply, 10)
+		call, _ := client.Open("StreamingArith.Thrive", args, replyChan)
+
+		count := 0
+		for reply := range replyChan {
+			if reply.Index != count {
+				t.Fatal("unexpected value:", reply.Index)
+			}
+			count += 1
+		}
+
+		if call.Error != nil {
+			t.Fatal("unexpected error:", call.Error.Error())
+		}
+
+		if count != 5 {
+			t.Fatal("Didn't receive the right number of packets back:", count)
+		}
+	})
+}
+
+// TestCloseWithInFlightStreamDoesNotPanic guards against a race between
+// Close tearing a session's channels down and its read loop still
+// delivering frames for them that were already off the wire: Close used
+// to close each channel's recv (and the session's pubCh) out from under
+// a concurrent send, which panics with "send on closed channel".
+func TestCloseWithInFlightStreamDoesNotPanic(t *testing.T) {
+	withEachCodec(t, func(t *testing.T, codec Codec) {
+		server := NewPeer(WithCodec(codec))
+		if err := server.Bind("127.0.0.1:9877"); err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		server.Register(new(DripArith))
+		go server.Serve()
+
+		client := NewPeer(WithCodec(codec))
+		if err := client.Connect("127.0.0.1:9877"); err != nil {
+			t.Fatal(err)
+		}
+
+		args := &StreamingArgs{3, 50, -1}
+		replyChan := make(chan *StreamingReply, 10)
+		if _, err := client.Open("DripArith.Drip", args, replyChan); err != nil {
+			t.Fatal(err)
+		}
+
+		// Give the stream time to get going, then race Close against
+		// whatever frames are already in flight.
+		time.Sleep(10 * time.Millisecond)
+		if err := client.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for range replyChan {
+		}
+	})
+}
+
+func TestStreamingInput(t *testing.T) {
+	withEachCodec(t, func(t *testing.T, codec Codec) {
+		client := NewPeer(WithCodec(codec))
+		if err := client.Bind("127.0.0.1:9876"); err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		server := NewPeer(WithCodec(codec))
+		if err := server.Connect("127.0.0.1:9876"); err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+
+		server.Register(new(StreamingArith))
+		go server.Serve()
+
+		input := new(SendStream)
+		reply := new(StreamingReply)
+		call, err := client.Open("StreamingArith.Sum", input, reply)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		input.Send(&StreamingArgs{9, 0, 0})
+		input.Send(&StreamingArgs{3, 0, 0})
+		input.Send(&StreamingArgs{3, 0, 0})
+		input.Send(&StreamingArgs{6, 0, 0})
+		input.SendLast(&StreamingArgs{9, 0, 0})
+
+		<-call.Done
+
+		if call.Error != nil {
+			t.Fatal("unexpected error:", call.Error.Error())
+		}
+
+		if reply.C != 30 {
+			t.Fatal("Didn't receive the right sum value back:", reply.C)
+		}
+	})
+}
+
+func TestStreamingInputOutput(t *testing.T) {
+	withEachCodec(t, func(t *testing.T, codec Codec) {
+		client := NewPeer(WithCodec(codec))
+		if err := client.Bind("127.0.0.1:9876"); err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		server := NewPeer(WithCodec(codec))
+		if err := server.Connect("127.0.0.1:9876"); err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+
+		server.Register(new(StreamingArith))
+		go server.Serve()
+
+		input := new(SendStream)
+		output := make(chan *StreamingReply, 10)
+		call, err := client.Open("StreamingArith.Echo", input, output)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		count := 0
+		go func() {
+			for reply := range output {
+				count += reply.Index
+			}
+		}()
+
+		input.Send(&StreamingArgs{1, 1, 0})
+		input.Send(&StreamingArgs{2, 1, 0})
+		time.Sleep(1 * time.Second)
+		input.Send(&StreamingArgs{3, 1, 0})
+		input.Send(&StreamingArgs{4, 1, 0})
+
+		if count < 2 {
+			t.Fatal("4 messages have been sent but only", count, "have been recieved")
+		}
+		input.SendLast(&StreamingArgs{5, 1, 0})
+
+		<-call.Done
+
+		if call.Error != nil {
+			t.Fatal("unexpected error:", call.Error.Error())
+		}
+
+		if count != 5 {
+			t.Fatal("Didn't receive the right number of values back:", count)
+		}
+	})
+}
+
+type FlowArgs struct {
+	Count int
+	Size  int
+}
+
+type FlowReply struct {
+	Data []byte
+}
+
+// FlowArith counts in sent how many of Blast's Sends have returned, so a
+// test can see how far the sender got rather than only how much the
+// receiver has read.
+type FlowArith struct {
+	sent int64
+}
+
+func (t *FlowArith) Blast(args FlowArgs, stream SendStream) error {
+	chunk := make([]byte, args.Size)
+	for i := 0; i < args.Count; i++ {
+		if err := stream.Send(&FlowReply{Data: chunk}); err != nil {
+			return err
+		}
+		atomic.AddInt64(&t.sent, 1)
+	}
+	return nil
+}
+
+func TestFlowControlBlocksSlowReader(t *testing.T) {
+	client := NewPeer(WithWindowSize(4096))
+	if err := client.Bind("127.0.0.1:9877"); err != nil {
 		t.Fatal(err)
 	}
 	defer client.Close()
-	server := NewPeer()
-	if err := server.Connect("127.0.0.1:9876"); err != nil {
+	server := NewPeer(WithWindowSize(4096))
+	if err := server.Connect("127.0.0.1:9877"); err != nil {
 		t.Fatal(err)
 	}
 	defer server.Close()
 
-	server.Register(new(StreamingArith))
+	svc := new(FlowArith)
+	server.Register(svc)
 	go server.Serve()
 
-	args := &StreamingArgs{3, 5, -1}
-	replyChan := make(chan *StreamingReply, 10)
-	call, _ := client.Open("StreamingArith.Thrive", args, replyChan)
+	// Unbuffered: nothing is read off it but a value or two, so a correctly
+	// flow-controlled sender must stall well short of Count messages
+	// instead of racing ahead and buffering all of them in memory.
+	out := make(chan *FlowReply)
+	args := FlowArgs{Count: 100, Size: 1024}
+	call, err := client.Open("FlowArith.Blast", args, out)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	count := 0
-	for reply := range replyChan {
-		if reply.Index != count {
-			t.Fatal("unexpected value:", reply.Index)
+	received := 0
+	select {
+	case <-out:
+		received++
+	case <-time.After(time.Second):
+		t.Fatal("expected at least one message")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case _, ok := <-out:
+		if ok {
+			received++
 		}
-		count += 1
+	default:
+	}
+	if sent := atomic.LoadInt64(&svc.sent); sent >= int64(args.Count) {
+		t.Fatal("sender did not block on a slow reader, window had no effect")
+	}
+
+	for range out {
+		received++
 	}
 
+	<-call.Done
 	if call.Error != nil {
 		t.Fatal("unexpected error:", call.Error.Error())
 	}
+	if received != args.Count {
+		t.Fatal("expected", args.Count, "messages, got", received)
+	}
+}
+
+// TestSlowChannelDoesNotStallOtherChannels guards against a channel whose
+// consumer has stopped draining Receive blocking delivery to every other
+// channel multiplexed on the same session: before each Channel got its
+// own dispatchLoop, the session's single read loop applied every frame
+// inline, so one stalled channel stalled the connection.
+func TestSlowChannelDoesNotStallOtherChannels(t *testing.T) {
+	client := NewPeer(WithWindowSize(4096))
+	if err := client.Bind("127.0.0.1:9879"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := NewPeer(WithWindowSize(4096))
+	if err := server.Connect("127.0.0.1:9879"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server.Register(new(FlowArith))
+	server.Register(new(Arith))
+	go server.Serve()
 
-	if count != 5 {
-		t.Fatal("Didn't receive the right number of packets back:", count)
+	// Opened but never drained: FlowArith.Blast's sender will fill its
+	// window and then its receiver's queue, and sit there indefinitely.
+	stalled := make(chan *FlowReply, 1)
+	if _, err := client.Open("FlowArith.Blast", FlowArgs{Count: 1000, Size: 1024}, stalled); err != nil {
+		t.Fatal(err)
 	}
+	time.Sleep(100 * time.Millisecond)
 
+	reply := new(Reply)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Call("Arith.Add", Args{A: 2, B: 3}, reply)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.C != 5 {
+			t.Fatal("unexpected result:", reply.C)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("an independent call stalled behind the undrained channel")
+	}
 }
 
-func TestStreamingInput(t *testing.T) {
+// mismatchedCodec is a distinct Codec identity used only to exercise
+// the handshake's mismatch path; its Encode/Decode are never reached.
+type mismatchedCodec struct{ gobCodec }
+
+func (mismatchedCodec) Name() string { return "mismatched" }
+
+func TestCallContextDeadlineExceeded(t *testing.T) {
 	client := NewPeer()
-	if err := client.Bind("127.0.0.1:9876"); err != nil {
+	if err := client.Bind("127.0.0.1:9879"); err != nil {
 		t.Fatal(err)
 	}
 	defer client.Close()
 	server := NewPeer()
-	if err := server.Connect("127.0.0.1:9876"); err != nil {
+	if err := server.Connect("127.0.0.1:9879"); err != nil {
 		t.Fatal(err)
 	}
 	defer server.Close()
 
-	server.Register(new(StreamingArith))
+	server.Register(new(Arith))
 	go server.Serve()
 
-	input := new(SendStream)
-	reply := new(StreamingReply)
-	call, err := client.Open("StreamingArith.Sum", input, reply)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	reply := new(Reply)
+	err := client.CallContext(ctx, "Arith.Slow", &Args{1, 2}, reply)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+// CancelArith.Grind sends as fast as its flow-control window allows and
+// reports the error it eventually got back from stream.Send on done, so
+// the test can observe the server side noticing a cancellation rather
+// than just inferring it from the client.
+type CancelArith struct {
+	done chan error
+}
+
+func (t *CancelArith) Grind(ctx context.Context, args StreamingArgs, stream SendStream) error {
+	reply := &StreamingReply{C: args.A}
+	var err error
+	for err == nil {
+		err = stream.Send(reply)
+	}
+	t.done <- err
+	return err
+}
+
+func TestOpenContextCancelMidStream(t *testing.T) {
+	client := NewPeer(WithWindowSize(256))
+	if err := client.Bind("127.0.0.1:9880"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := NewPeer(WithWindowSize(256))
+	if err := server.Connect("127.0.0.1:9880"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	svc := &CancelArith{done: make(chan error, 1)}
+	server.Register(svc)
+	go server.Serve()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	out := make(chan *StreamingReply)
+	call, err := client.OpenContext(ctx, "CancelArith.Grind", StreamingArgs{A: 1}, out)
 	if err != nil {
-		t.Fatal(err.Error())
+		t.Fatal(err)
 	}
 
-	input.Send(&StreamingArgs{9, 0, 0})
-	input.Send(&StreamingArgs{3, 0, 0})
-	input.Send(&StreamingArgs{3, 0, 0})
-	input.Send(&StreamingArgs{6, 0, 0})
-	input.SendLast(&StreamingArgs{9, 0, 0})
+	// Keep draining out so deliverAttempt is always parked in ch.Receive,
+	// which is what a CANCEL frame actually interrupts; if it were
+	// blocked handing a message to out instead, cancellation wouldn't
+	// show up until the next read anyway.
+	go func() {
+		for range out {
+		}
+	}()
 
-	<-call.Done
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-svc.done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("server: expected context.Canceled, got %v", err)
+		}
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("server did not observe cancellation within 50ms")
+	}
+
+	select {
+	case <-call.Done:
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("client did not observe cancellation within 50ms")
+	}
+	if !errors.Is(call.Error, context.Canceled) {
+		t.Fatalf("client: expected context.Canceled, got %v", call.Error)
+	}
+}
+
+func TestConnectFailsOnCodecMismatch(t *testing.T) {
+	server := NewPeer(WithCodec(gobCodec{}))
+	if err := server.Bind("127.0.0.1:9878"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client := NewPeer(WithCodec(mismatchedCodec{}))
+	err := client.Connect("127.0.0.1:9878")
+	if err == nil {
+		client.Close()
+		t.Fatal("expected Connect to fail on codec mismatch")
+	}
+}
+
+// labelingClientInterceptor appends name to trace (guarded by mu, since
+// the chain can run from either TestClientInterceptorsRunInRegistrationOrder
+// goroutine) both before and after calling next, so a test can tell not
+// just that it ran but that it nested correctly around the rest of the
+// chain.
+func labelingClientInterceptor(mu *sync.Mutex, trace *[]string, name string) ClientInterceptor {
+	return func(ctx context.Context, method string, in, out interface{}, next ClientHandler) (*Call, error) {
+		mu.Lock()
+		*trace = append(*trace, name+":before")
+		mu.Unlock()
+		call, err := next(ctx, method, in, out)
+		mu.Lock()
+		*trace = append(*trace, name+":after")
+		mu.Unlock()
+		return call, err
+	}
+}
+
+func TestClientInterceptorsRunInRegistrationOrder(t *testing.T) {
+	client := NewPeer()
+	if err := client.Bind("127.0.0.1:9881"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := NewPeer()
+	if err := server.Connect("127.0.0.1:9881"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server.Register(new(Arith))
+	go server.Serve()
+
+	var mu sync.Mutex
+	var trace []string
+	client.Use(labelingClientInterceptor(&mu, &trace, "outer"))
+	client.Use(labelingClientInterceptor(&mu, &trace, "inner"))
+
+	want := []string{"outer:before", "inner:before", "inner:after", "outer:after"}
 
+	// Call and Open both funnel through OpenContext, so the same chain
+	// must wrap both identically.
+	reply := new(Reply)
+	if err := client.Call("Arith.Add", &Args{1, 2}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(trace, want) {
+		t.Fatalf("Call: got trace %v, want %v", trace, want)
+	}
+
+	trace = nil
+	call, err := client.Open("Arith.Add", &Args{3, 4}, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-call.Done
 	if call.Error != nil {
-		t.Fatal("unexpected error:", call.Error.Error())
+		t.Fatal(call.Error)
+	}
+	if !reflect.DeepEqual(trace, want) {
+		t.Fatalf("Open: got trace %v, want %v", trace, want)
+	}
+}
+
+// labelingServerInterceptor is labelingClientInterceptor's server-side
+// counterpart.
+func labelingServerInterceptor(mu *sync.Mutex, trace *[]string, name string) ServerInterceptor {
+	return func(ctx context.Context, method string, ch *Channel, next ServerHandler) {
+		mu.Lock()
+		*trace = append(*trace, name+":before")
+		mu.Unlock()
+		next(ctx, method, ch)
+		mu.Lock()
+		*trace = append(*trace, name+":after")
+		mu.Unlock()
+	}
+}
+
+func TestServerInterceptorsRunInRegistrationOrder(t *testing.T) {
+	client := NewPeer()
+	if err := client.Bind("127.0.0.1:9882"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := NewPeer()
+	if err := server.Connect("127.0.0.1:9882"); err != nil {
+		t.Fatal(err)
 	}
+	defer server.Close()
+
+	var mu sync.Mutex
+	var trace []string
+	server.UseServer(labelingServerInterceptor(&mu, &trace, "outer"))
+	server.UseServer(labelingServerInterceptor(&mu, &trace, "inner"))
+	server.Register(new(Arith))
+	go server.Serve()
 
-	if reply.C != 30 {
-		t.Fatal("Didn't receive the right sum value back:", reply.C)
+	reply := new(Reply)
+	if err := client.Call("Arith.Add", &Args{1, 2}, reply); err != nil {
+		t.Fatal(err)
 	}
 
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"outer:before", "inner:before", "inner:after", "outer:after"}
+	if !reflect.DeepEqual(trace, want) {
+		t.Fatalf("got trace %v, want %v", trace, want)
+	}
 }
 
-func TestStreamingInputOutput(t *testing.T) {
+func TestServerInterceptorRejectsWithoutCallingNext(t *testing.T) {
 	client := NewPeer()
-	if err := client.Bind("127.0.0.1:9876"); err != nil {
+	if err := client.Bind("127.0.0.1:9883"); err != nil {
 		t.Fatal(err)
 	}
 	defer client.Close()
 	server := NewPeer()
-	if err := server.Connect("127.0.0.1:9876"); err != nil {
+	if err := server.Connect("127.0.0.1:9883"); err != nil {
 		t.Fatal(err)
 	}
 	defer server.Close()
 
-	server.Register(new(StreamingArith))
+	rejectErr := errors.New("denied")
+	server.UseServer(func(ctx context.Context, method string, ch *Channel, next ServerHandler) {
+		ch.SendError(rejectErr)
+	})
+	server.Register(new(Arith))
 	go server.Serve()
 
-	input := new(SendStream)
-	output := make(chan *StreamingReply, 10)
-	call, err := client.Open("StreamingArith.Echo", input, output)
+	reply := new(Reply)
+	err := client.Call("Arith.Add", &Args{1, 2}, reply)
+	if err == nil || err.Error() != rejectErr.Error() {
+		t.Fatalf("got %v, want %q", err, rejectErr)
+	}
+}
+
+// DripArith streams its replies with a short pause between each, giving
+// a test time to kill the serving peer mid-stream.
+type DripArith int
+
+func (t *DripArith) Drip(args StreamingArgs, stream SendStream) error {
+	for i := 0; i < args.Count; i++ {
+		if err := stream.Send(&StreamingReply{C: args.A, Index: i}); err != nil {
+			return nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestRoundRobinSelectorCyclesEndpoints(t *testing.T) {
+	client := NewPeer()
+	defer client.Close()
+
+	addrs := []string{"127.0.0.1:9991", "127.0.0.1:9992", "127.0.0.1:9993"}
+	for _, addr := range addrs {
+		server := NewPeer()
+		if err := server.Bind(addr); err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		server.Register(new(Arith))
+		go server.Serve()
+	}
+	for _, addr := range addrs {
+		if err := client.Connect(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < len(addrs); i++ {
+		ep, err := client.selector.Select("Arith.Add", Args{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[ep.Addr] = true
+	}
+	if len(seen) != len(addrs) {
+		t.Fatalf("round robin only visited %d of %d endpoints: %v", len(seen), len(addrs), seen)
+	}
+}
+
+func TestStreamingFailoverRetriesOnHealthyEndpoint(t *testing.T) {
+	client := NewPeer()
+	defer client.Close()
+
+	addrs := []string{"127.0.0.1:9994", "127.0.0.1:9995", "127.0.0.1:9996"}
+	servers := make([]*Peer, len(addrs))
+	for i, addr := range addrs {
+		s := NewPeer()
+		if err := s.Bind(addr); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		s.Register(new(DripArith))
+		go s.Serve()
+		servers[i] = s
+	}
+	for _, addr := range addrs {
+		if err := client.Connect(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	args := &StreamingArgs{A: 7, Count: 6}
+	replyChan := make(chan *StreamingReply, 20)
+	call, err := client.Open("DripArith.Drip", args, replyChan, WithRetry(2))
 	if err != nil {
-		t.Fatal(err.Error())
+		t.Fatal(err)
 	}
 
-	count := 0
-	go func() {
-		for reply := range output {
-			count += reply.Index
+	received := 0
+	killed := false
+	for reply := range replyChan {
+		if reply.C != args.A {
+			t.Fatal("unexpected value:", reply.C)
+		}
+		received++
+		if !killed && received == 2 {
+			// The default RoundRobinSelector picks endpoints in Connect
+			// order, so the first attempt landed on servers[0]; killing
+			// it should make the retry land on a healthy endpoint
+			// without the caller ever seeing an error.
+			servers[0].Close()
+			killed = true
 		}
+	}
+
+	if call.Error != nil {
+		t.Fatal("unexpected error:", call.Error)
+	}
+	if received < args.Count {
+		t.Fatalf("got %d replies, want at least %d", received, args.Count)
+	}
+}
+
+type TempReading struct {
+	Room string
+	Deg  int
+}
+
+func TestPubSubDeliversInOrderAcrossThreePeers(t *testing.T) {
+	addrs := []string{"127.0.0.1:9997", "127.0.0.1:9998", "127.0.0.1:9999"}
+	peers := make([]*Peer, len(addrs))
+	for i, addr := range addrs {
+		p := NewPeer()
+		if err := p.Bind(addr); err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		peers[i] = p
+	}
+	// Full mesh: every peer has a direct session to every other, so a
+	// Publish from any one of them can reach the other two without
+	// relaying.
+	if err := peers[0].Connect(addrs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := peers[0].Connect(addrs[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := peers[1].Connect(addrs[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	received := make(map[int][]TempReading)
+	for i, p := range peers {
+		i := i
+		_, err := p.Subscribe("events.temp.*", func(r TempReading) {
+			mu.Lock()
+			received[i] = append(received[i], r)
+			mu.Unlock()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Subscriptions announce themselves asynchronously; give the
+	// frameSubscribe frames time to land before publishing.
+	time.Sleep(50 * time.Millisecond)
+
+	readings := []TempReading{
+		{Room: "kitchen", Deg: 68},
+		{Room: "bath", Deg: 71},
+		{Room: "attic", Deg: 80},
+	}
+	for _, r := range readings {
+		if err := peers[0].Publish("events.temp."+r.Room, r, WithAtLeastOnce()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// peers[0] published these, so it never delivers them to itself;
+	// only peers[1] and peers[2] should have received them.
+	for i := 1; i < len(peers); i++ {
+		deadline := time.Now().Add(time.Second)
+		for {
+			mu.Lock()
+			n := len(received[i])
+			mu.Unlock()
+			if n >= len(readings) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("peer %d only received %d of %d readings", i, n, len(readings))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 1; i < len(peers); i++ {
+		if len(received[i]) != len(readings) {
+			t.Fatalf("peer %d: got %d readings, want %d", i, len(received[i]), len(readings))
+		}
+		for j, r := range received[i] {
+			if r != readings[j] {
+				t.Fatalf("peer %d: reading %d = %+v, want %+v (out of order or wrong)", i, j, r, readings[j])
+			}
+		}
+	}
+}
+
+func TestPubSubWildcardDoesNotMatchOtherTopics(t *testing.T) {
+	server := NewPeer()
+	if err := server.Bind("127.0.0.1:9996"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client := NewPeer()
+	if err := client.Connect("127.0.0.1:9996"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	got := make(chan TempReading, 4)
+	if _, err := server.Subscribe("events.temp.*", func(r TempReading) {
+		got <- r
+	}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if err := client.Publish("events.humidity.kitchen", TempReading{Room: "kitchen", Deg: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Publish("events.temp", TempReading{Room: "none", Deg: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Publish("events.temp.kitchen", TempReading{Room: "kitchen", Deg: 68}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-got:
+		if r.Room != "kitchen" || r.Deg != 68 {
+			t.Fatalf("got %+v, want the matching reading", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the matching publish")
+	}
+
+	select {
+	case r := <-got:
+		t.Fatalf("received an extra, non-matching publish: %+v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestPublishWithAtLeastOnceBlocksUntilAcked asserts WithAtLeastOnce's
+// actual contract -- Publish blocks until every matching subscriber has
+// acknowledged -- rather than just that it doesn't error. A subscriber
+// whose handler is still running withholds the ack (see deliverPublish),
+// so a deliberately slow handler makes a regression that turned
+// WithAtLeastOnce into a no-op observable: Publish would return long
+// before the handler does.
+func TestPublishWithAtLeastOnceBlocksUntilAcked(t *testing.T) {
+	server := NewPeer()
+	if err := server.Bind("127.0.0.1:9885"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client := NewPeer()
+	if err := client.Connect("127.0.0.1:9885"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	handlerStarted := make(chan struct{})
+	release := make(chan struct{})
+	if _, err := server.Subscribe("events.slow", func(r TempReading) {
+		close(handlerStarted)
+		<-release
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Subscriptions announce themselves asynchronously; give the
+	// frameSubscribe frame time to land before publishing.
+	time.Sleep(50 * time.Millisecond)
+
+	publishDone := make(chan error, 1)
+	go func() {
+		publishDone <- client.Publish("events.slow", TempReading{Room: "kitchen", Deg: 68}, WithAtLeastOnce())
 	}()
 
-	input.Send(&StreamingArgs{1, 1, 0})
-	input.Send(&StreamingArgs{2, 1, 0})
-	time.Sleep(1 * time.Second)
-	input.Send(&StreamingArgs{3, 1, 0})
-	input.Send(&StreamingArgs{4, 1, 0})
+	select {
+	case <-handlerStarted:
+	case <-time.After(time.Second):
+		t.Fatal("subscriber handler never started")
+	}
 
-	if count < 2 {
-		t.Fatal("4 messages have been sent but only", count, "have been recieved")
+	// The handler is still blocked on release, so nothing has acked yet:
+	// Publish must still be waiting.
+	select {
+	case err := <-publishDone:
+		t.Fatalf("Publish returned before its subscriber acked (err=%v)", err)
+	case <-time.After(100 * time.Millisecond):
 	}
-	input.SendLast(&StreamingArgs{5, 1, 0})
 
-	<-call.Done
+	close(release)
 
-	if call.Error != nil {
-		t.Fatal("unexpected error:", call.Error.Error())
+	select {
+	case err := <-publishDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Publish did not return after its subscriber acked")
 	}
+}
 
-	if count != 5 {
-		t.Fatal("Didn't receive the right number of values back:", count)
+// BlackHole drives a channel by simply never reading from it, so a
+// caller's Send calls are never credited by a WINDOW_UPDATE -- the
+// worst case for WithMaxPendingBytes's session-wide accounting. It
+// exits only when the channel's own context ends (the caller closed or
+// canceled it), the same as any modeChannel handler that needs to
+// observe cancellation.
+type BlackHole struct{}
+
+func (b *BlackHole) Swallow(ctx context.Context, ch *Channel) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// TestMaxPendingBytesReleasedWhenChannelFinishes guards against
+// WithMaxPendingBytes's session-wide cap only ever growing: a channel
+// that finishes with bytes still unacknowledged -- canceled, errored, or
+// just never drained by its peer -- must have its contribution released
+// back to the cap, or enough short-lived canceled streams eventually
+// wedge every future Send on the session even though nothing is still
+// using that "window".
+func TestMaxPendingBytesReleasedWhenChannelFinishes(t *testing.T) {
+	client := NewPeer(WithMaxPendingBytes(500))
+	if err := client.Bind("127.0.0.1:9884"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := NewPeer()
+	if err := server.Connect("127.0.0.1:9884"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server.Register(new(BlackHole))
+	go server.Serve()
+
+	// Open a call whose input stream BlackHole never reads, send into it
+	// until the session's cap blocks Send, then cancel -- five times in
+	// a row. If a canceled channel's share of the cap were never
+	// released, each round would permanently eat into it.
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		input := new(SendStream)
+		out := make(chan *StreamingReply, 1)
+		call, err := client.OpenContext(ctx, "BlackHole.Swallow", input, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sendBlocked := make(chan struct{})
+		go func() {
+			defer close(sendBlocked)
+			for input.Send(&StreamingArgs{A: 1}) == nil {
+			}
+		}()
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+
+		select {
+		case <-sendBlocked:
+		case <-time.After(time.Second):
+			t.Fatalf("round %d: Send loop did not unblock within a second of cancel", i)
+		}
+		select {
+		case <-call.Done:
+		case <-time.After(time.Second):
+			t.Fatalf("round %d: call did not finish within a second of cancel", i)
+		}
 	}
 
+	// A fresh call on the session must still be able to send: if the
+	// cap were never released, acquireWindow would already see it
+	// exhausted and this would block forever.
+	ctx, cancel := context.WithCancel(context.Background())
+	input := new(SendStream)
+	out := make(chan *StreamingReply, 1)
+	call, err := client.OpenContext(ctx, "BlackHole.Swallow", input, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendErr := make(chan error, 1)
+	go func() { sendErr <- input.Send(&StreamingArgs{A: 1}) }()
+	select {
+	case err := <-sendErr:
+		if err != nil {
+			t.Fatalf("a fresh channel on the session could not send after earlier channels were canceled: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a fresh channel on the session could not make progress after earlier channels were canceled -- maxPendingBytes never released")
+	}
+	cancel()
+	<-call.Done
 }
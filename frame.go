@@ -0,0 +1,152 @@
+package duplex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// frameType identifies what a frame carries on the wire.
+type frameType uint8
+
+const (
+	// frameOpen starts a new channel; method names the registered
+	// handler and payload (if any) is the Codec-encoded call argument.
+	frameOpen frameType = iota + 1
+	// frameData carries one Codec-encoded message on an open channel.
+	frameData
+	// frameClose signals that the sender is done sending on a channel.
+	frameClose
+	// frameError aborts a channel; payload is a UTF-8 error string.
+	frameError
+	// frameWindowUpdate returns flow-control credit to a sender;
+	// payload is a big-endian uint32 byte count.
+	frameWindowUpdate
+	// frameHello is exchanged once, before any channel exists, to
+	// negotiate the Codec a session's frameData/frameOpen payloads use.
+	// payload is the codec's Name().
+	frameHello
+	// frameCancel aborts a channel the way frameError does, but from the
+	// side that gave up rather than the side that failed; payload is a
+	// single cancelReason byte so the receiver can tell a deadline from
+	// an explicit cancellation.
+	frameCancel
+	// frameSubscribe announces interest in a topic pattern to every
+	// session a Peer has open, so the peer on the other end knows where
+	// to route a matching Publish. method is the pattern (see Subscribe).
+	frameSubscribe
+	// frameUnsubscribe retracts a frameSubscribe announcement once a
+	// Peer has no more local subscriptions matching the pattern.
+	frameUnsubscribe
+	// framePublish delivers one published message. id is the publish's
+	// sequence number (only meaningful together with framePublishAck);
+	// method is the topic; payload is a leading ack-required byte
+	// followed by the codec-encoded message.
+	framePublish
+	// framePublishAck acknowledges a framePublish sent with its ack byte
+	// set; id echoes the framePublish's id.
+	framePublishAck
+)
+
+// maxFrameSize bounds how large a single frame's body may declare itself
+// to be, so a corrupt length prefix -- or a hostile peer -- can't force
+// readFrame to attempt a multi-gigabyte allocation before any of the
+// frame has actually been validated.
+const maxFrameSize = 64 << 20 // 64 MiB
+
+// cancelReason classifies why a frameCancel was sent.
+type cancelReason byte
+
+const (
+	cancelCanceled cancelReason = iota
+	cancelDeadlineExceeded
+)
+
+// frame is one message on the wire: method is only populated for
+// frameOpen (the handler name) and for frameSubscribe, frameUnsubscribe
+// and framePublish (the topic or pattern); payload is the frame's body.
+type frame struct {
+	id      uint64
+	typ     frameType
+	method  string
+	payload []byte
+}
+
+func writeFrame(w io.Writer, f *frame) error {
+	method := []byte(f.method)
+	total := 8 + 1 + 2 + len(method) + 4 + len(f.payload)
+	buf := make([]byte, 4+total)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(total))
+	binary.BigEndian.PutUint64(buf[4:12], f.id)
+	buf[12] = byte(f.typ)
+	binary.BigEndian.PutUint16(buf[13:15], uint16(len(method)))
+	off := 15
+	copy(buf[off:off+len(method)], method)
+	off += len(method)
+	binary.BigEndian.PutUint32(buf[off:off+4], uint32(len(f.payload)))
+	off += 4
+	copy(buf[off:], f.payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) (*frame, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	total := binary.BigEndian.Uint32(lenBuf[:])
+	if total > maxFrameSize {
+		return nil, fmt.Errorf("duplex: frame of %d bytes exceeds max frame size %d", total, maxFrameSize)
+	}
+	body := make([]byte, total)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if len(body) < 11 {
+		return nil, fmt.Errorf("duplex: short frame")
+	}
+	f := &frame{
+		id:  binary.BigEndian.Uint64(body[0:8]),
+		typ: frameType(body[8]),
+	}
+	methodLen := int(binary.BigEndian.Uint16(body[9:11]))
+	off := 11
+	if off+methodLen+4 > len(body) {
+		return nil, fmt.Errorf("duplex: frame method/payload length out of bounds")
+	}
+	f.method = string(body[off : off+methodLen])
+	off += methodLen
+	payloadLen := int(binary.BigEndian.Uint32(body[off : off+4]))
+	off += 4
+	if off+payloadLen > len(body) {
+		return nil, fmt.Errorf("duplex: frame method/payload length out of bounds")
+	}
+	f.payload = body[off : off+payloadLen]
+	return f, nil
+}
+
+// encodeValue encodes v with codec into the payload format frameData and
+// frameOpen arguments use on the wire.
+func encodeValue(codec Codec, v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := codec.Encode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeValue(codec Codec, data []byte, v interface{}) error {
+	return codec.Decode(bytes.NewReader(data), v)
+}
+
+func encodeUint32(n int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	return b
+}
+
+func decodeUint32(b []byte) int {
+	return int(binary.BigEndian.Uint32(b))
+}
@@ -0,0 +1,86 @@
+package duplex
+
+import "context"
+
+// ClientHandler performs the actual Open round trip once a Peer's
+// ClientInterceptor chain has run. It is the terminal step every chain
+// ends in, analogous to gRPC's UnaryInvoker.
+type ClientHandler func(ctx context.Context, method string, in, out interface{}) (*Call, error)
+
+// ClientInterceptor wraps every call a Peer makes -- Call, CallContext,
+// Open, and OpenContext all funnel through OpenContext, so registering
+// one interceptor covers all four. Use Peer.Use to register one;
+// interceptors run in registration order, each wrapping next, which
+// continues the chain (calling the real OpenContext once every
+// interceptor has run).
+//
+// An interceptor may rewrite method before calling next; the rewritten
+// name is what ends up in the call's frameOpen and, on the server side,
+// what ServerInterceptors and Register'd methods see.
+type ClientInterceptor func(ctx context.Context, method string, in, out interface{}, next ClientHandler) (*Call, error)
+
+// chainClient composes interceptors around terminal so the first
+// registered interceptor is outermost: it runs first and its next is the
+// second interceptor, and so on, ending in terminal.
+func chainClient(interceptors []ClientInterceptor, terminal ClientHandler) ClientHandler {
+	h := terminal
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		ic, next := interceptors[i], h
+		h = func(ctx context.Context, method string, in, out interface{}) (*Call, error) {
+			return ic(ctx, method, in, out, next)
+		}
+	}
+	return h
+}
+
+// Use registers a ClientInterceptor that wraps every call this Peer
+// makes. Interceptors run in registration order: the first one
+// registered is outermost and sees the call first.
+func (p *Peer) Use(i ClientInterceptor) {
+	p.mu.Lock()
+	p.clientInterceptors = append(p.clientInterceptors, i)
+	p.mu.Unlock()
+}
+
+// ServerHandler dispatches a call to its registered method once a Peer's
+// ServerInterceptor chain has run. It is the terminal step every chain
+// ends in.
+type ServerHandler func(ctx context.Context, method string, ch *Channel)
+
+// ServerInterceptor wraps every call a Peer dispatches to a registered
+// method. Unary, stream-out, and full-duplex methods all dispatch
+// through the same *Channel, so one interceptor type covers all three --
+// there is no separate streaming variant to register. Use Peer.UseServer
+// to register one; interceptors run in registration order, each wrapping
+// next, which continues the chain (invoking the real method once every
+// interceptor has run).
+//
+// An interceptor that wants to reject a call -- a failed auth check, say
+// -- can call ch.SendError and return without calling next.
+//
+// An interceptor may rewrite method before calling next; the rewritten
+// name is what Register'd methods are looked up by.
+type ServerInterceptor func(ctx context.Context, method string, ch *Channel, next ServerHandler)
+
+// chainServer composes interceptors around terminal the same way
+// chainClient does.
+func chainServer(interceptors []ServerInterceptor, terminal ServerHandler) ServerHandler {
+	h := terminal
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		ic, next := interceptors[i], h
+		h = func(ctx context.Context, method string, ch *Channel) {
+			ic(ctx, method, ch, next)
+		}
+	}
+	return h
+}
+
+// UseServer registers a ServerInterceptor that wraps every call this
+// Peer dispatches to a registered method. Interceptors run in
+// registration order: the first one registered is outermost and sees
+// the call first.
+func (p *Peer) UseServer(i ServerInterceptor) {
+	p.mu.Lock()
+	p.serverInterceptors = append(p.serverInterceptors, i)
+	p.mu.Unlock()
+}
@@ -0,0 +1,29 @@
+// Package jsoncodec implements duplex.Codec using plain JSON, for peers
+// that would rather exchange human-readable payloads than use duplex's
+// gob default.
+//
+// This is not JSON-RPC 2.0: duplex's own frame (see frame.go) already
+// carries the method name, a channel id, and length -- the pieces a
+// JSON-RPC envelope would duplicate -- and Codec only ever sees one
+// value at a time, with no access to that framing. A non-Go peer still
+// can't talk to duplex with this codec; it only changes how the value
+// inside each frame is encoded.
+package jsoncodec
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Codec is the JSON duplex.Codec. The zero value is ready to use.
+type Codec struct{}
+
+func (Codec) Name() string { return "json" }
+
+func (Codec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (Codec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
@@ -0,0 +1,33 @@
+package protocodec
+
+import (
+	"bytes"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var codec Codec
+	var buf bytes.Buffer
+
+	in := wrapperspb.String("hello protocodec")
+	if err := codec.Encode(&buf, in); err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(wrapperspb.StringValue)
+	if err := codec.Decode(&buf, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.GetValue() != in.GetValue() {
+		t.Fatalf("got %q, want %q", out.GetValue(), in.GetValue())
+	}
+}
+
+func TestEncodeRejectsNonProtoMessage(t *testing.T) {
+	var codec Codec
+	if err := codec.Encode(&bytes.Buffer{}, struct{ X int }{X: 1}); err == nil {
+		t.Fatal("expected error encoding a non-proto.Message value")
+	}
+}
@@ -0,0 +1,264 @@
+package duplex
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+)
+
+// Subscription is returned by Subscribe and stops delivery to its
+// handler when Unsubscribe is called.
+type Subscription interface {
+	Unsubscribe()
+}
+
+type subscription struct {
+	p       *Peer
+	topic   string
+	handler reflect.Value
+	msgType reflect.Type
+}
+
+func (s *subscription) Unsubscribe() {
+	s.p.unsubscribe(s)
+}
+
+// PublishOption configures a single Publish call.
+type PublishOption func(*publishOptions)
+
+type publishOptions struct {
+	atLeastOnce bool
+}
+
+// WithAtLeastOnce makes Publish block until every session with a
+// matching subscription has acknowledged the message, instead of
+// firing it and returning immediately (at-most-once, the default).
+func WithAtLeastOnce() PublishOption {
+	return func(o *publishOptions) { o.atLeastOnce = true }
+}
+
+// pendingAck tracks the sessions Publish is still waiting on an ack
+// from for one at-least-once call; done closes once remaining is empty.
+type pendingAck struct {
+	remaining map[*session]bool
+	done      chan struct{}
+}
+
+// topicMatches reports whether pattern -- topic as given to Subscribe,
+// either an exact name or one ending in a trailing "*" wildcard segment
+// -- matches topic as given to Publish. The wildcard stands for exactly
+// one segment, not an arbitrary suffix: "events.temp.*" matches
+// "events.temp.kitchen" but not "events.temp" or "events.temp.a.b".
+func topicMatches(pattern, topic string) bool {
+	pSegs := strings.Split(pattern, ".")
+	tSegs := strings.Split(topic, ".")
+	if len(pSegs) != len(tSegs) {
+		return false
+	}
+	for i, p := range pSegs {
+		if p == "*" {
+			continue
+		}
+		if p != tSegs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscribe registers handler, a func(T) for some message type T, to be
+// called with every message Published to a topic matching pattern on
+// any session this Peer has open, now or in the future (see Connect and
+// Bind). It announces the subscription to every connected session so
+// their Publish calls know to route matching messages here.
+func (p *Peer) Subscribe(pattern string, handler interface{}) (Subscription, error) {
+	hv := reflect.ValueOf(handler)
+	ht := hv.Type()
+	if ht.Kind() != reflect.Func || ht.NumIn() != 1 || ht.NumOut() != 0 {
+		return nil, errors.New("duplex: subscribe handler must be a func(T) with no return value")
+	}
+	sub := &subscription{p: p, topic: pattern, handler: hv, msgType: ht.In(0)}
+
+	p.mu.Lock()
+	p.subs = append(p.subs, sub)
+	firstForPattern := p.localTopicRefs[pattern] == 0
+	p.localTopicRefs[pattern]++
+	sessions := append([]*session(nil), p.sessions...)
+	p.mu.Unlock()
+
+	if firstForPattern {
+		for _, sess := range sessions {
+			sess.writeFrame(&frame{typ: frameSubscribe, method: pattern})
+		}
+	}
+	return sub, nil
+}
+
+func (p *Peer) unsubscribe(sub *subscription) {
+	p.mu.Lock()
+	for i, s := range p.subs {
+		if s == sub {
+			p.subs = append(p.subs[:i], p.subs[i+1:]...)
+			break
+		}
+	}
+	p.localTopicRefs[sub.topic]--
+	lastForPattern := p.localTopicRefs[sub.topic] <= 0
+	if lastForPattern {
+		delete(p.localTopicRefs, sub.topic)
+	}
+	sessions := append([]*session(nil), p.sessions...)
+	p.mu.Unlock()
+
+	if lastForPattern {
+		for _, sess := range sessions {
+			sess.writeFrame(&frame{typ: frameUnsubscribe, method: sub.topic})
+		}
+	}
+}
+
+// addRemoteInterest records that sess's peer announced interest in
+// pattern, so a later Publish on this Peer knows to route a matching
+// topic to sess.
+func (p *Peer) addRemoteInterest(sess *session, pattern string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	topics := p.remoteInterest[sess]
+	if topics == nil {
+		topics = make(map[string]bool)
+		p.remoteInterest[sess] = topics
+	}
+	topics[pattern] = true
+}
+
+func (p *Peer) removeRemoteInterest(sess *session, pattern string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.remoteInterest[sess], pattern)
+}
+
+// Publish encodes msg and sends it to every session whose peer has
+// announced interest in a pattern matching topic (see Subscribe). With
+// WithAtLeastOnce, it blocks until every one of those sessions has
+// acknowledged the message; otherwise it returns as soon as the message
+// is written.
+func (p *Peer) Publish(topic string, msg interface{}, opts ...PublishOption) error {
+	var po publishOptions
+	for _, opt := range opts {
+		opt(&po)
+	}
+
+	payload, err := encodeValue(p.codec, msg)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	var targets []*session
+	for sess, patterns := range p.remoteInterest {
+		for pattern := range patterns {
+			if topicMatches(pattern, topic) {
+				targets = append(targets, sess)
+				break
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	if len(targets) == 0 {
+		return nil
+	}
+
+	ackByte := byte(0)
+	var pending *pendingAck
+	var id uint64
+	if po.atLeastOnce {
+		ackByte = 1
+		pending = &pendingAck{remaining: make(map[*session]bool, len(targets)), done: make(chan struct{})}
+		for _, sess := range targets {
+			pending.remaining[sess] = true
+		}
+		p.mu.Lock()
+		p.nextPublishID++
+		id = p.nextPublishID
+		p.pendingAcks[id] = pending
+		p.mu.Unlock()
+	}
+
+	body := make([]byte, 1+len(payload))
+	body[0] = ackByte
+	copy(body[1:], payload)
+
+	for _, sess := range targets {
+		if err := sess.writeFrame(&frame{id: id, typ: framePublish, method: topic, payload: body}); err != nil && pending != nil {
+			p.ackPublish(sess, id)
+		}
+	}
+
+	if pending != nil {
+		<-pending.done
+	}
+	return nil
+}
+
+// deliverPublish is called by sess's publish queue (see publishLoop) for
+// an incoming framePublish. It decodes the message once per matching
+// local subscription and invokes its handler, in the order frames arrive
+// on sess, so subscribers see messages on one session in the order they
+// were Published. It acks whenever the frame asked for one, regardless
+// of whether a local subscription still matches: the sender picked sess
+// as a target because it had once announced interest, and a concurrent
+// Unsubscribe racing the frame's arrival must not make an at-least-once
+// Publish wait forever for an ack that will never come.
+func (p *Peer) deliverPublish(sess *session, f *frame) {
+	if len(f.payload) == 0 {
+		return
+	}
+	ackRequired := f.payload[0] != 0
+	body := f.payload[1:]
+
+	p.mu.Lock()
+	var matched []*subscription
+	for _, sub := range p.subs {
+		if topicMatches(sub.topic, f.method) {
+			matched = append(matched, sub)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, sub := range matched {
+		msgv := reflect.New(deref(sub.msgType))
+		if err := decodeValue(p.codec, body, msgv.Interface()); err != nil {
+			continue
+		}
+		arg := msgv.Elem()
+		if sub.msgType.Kind() == reflect.Ptr {
+			arg = msgv
+		}
+		sub.handler.Call([]reflect.Value{arg})
+	}
+
+	if ackRequired {
+		sess.writeFrame(&frame{id: f.id, typ: framePublishAck})
+	}
+}
+
+// ackPublish records that sess has acknowledged publish id, completing
+// the Publish call waiting on it once every session it addressed has.
+func (p *Peer) ackPublish(sess *session, id uint64) {
+	p.mu.Lock()
+	pending := p.pendingAcks[id]
+	if pending == nil {
+		p.mu.Unlock()
+		return
+	}
+	delete(pending.remaining, sess)
+	done := len(pending.remaining) == 0
+	if done {
+		delete(p.pendingAcks, id)
+	}
+	p.mu.Unlock()
+	if done {
+		close(pending.done)
+	}
+}
@@ -0,0 +1,281 @@
+package duplex
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// ErrNoEndpoints is returned by a Selector's Select when it has no
+// Endpoint to choose -- typically because the owning Peer has not yet
+// connected anywhere, or every Endpoint has been pruned as unhealthy.
+var ErrNoEndpoints = errors.New("duplex: no endpoints available")
+
+// Endpoint is one of the connections a Peer's Selector chooses among for
+// an outgoing Call or Open. Addr is the dialed address, or the remote
+// address for a connection accepted by Bind; it is the only field a
+// Selector implementation needs to make its decision.
+type Endpoint struct {
+	Addr string
+	sess *session
+}
+
+// Selector picks which of a Peer's connected Endpoints an outgoing Call
+// or Open should use, and learns whether that choice worked out. See
+// Peer.SetSelector.
+type Selector interface {
+	// Select returns the Endpoint an outgoing call to method with
+	// arguments args should use.
+	Select(method string, args interface{}) (*Endpoint, error)
+	// Report tells the Selector how a call issued against ep turned
+	// out; err is nil on success.
+	Report(ep *Endpoint, err error)
+	// Endpoints replaces the Selector's view of which Endpoints are
+	// currently connected. It is called every time a Peer's pool of
+	// connections changes -- a successful Connect, a connection accepted
+	// by Bind, or a lost connection -- and when SetSelector installs it.
+	Endpoints(eps []*Endpoint)
+}
+
+// RoundRobinSelector cycles through its Endpoints in order. It is the
+// default Selector a Peer uses until SetSelector installs another.
+type RoundRobinSelector struct {
+	mu   sync.Mutex
+	eps  []*Endpoint
+	next int
+}
+
+// NewRoundRobinSelector creates a RoundRobinSelector with no Endpoints.
+func NewRoundRobinSelector() *RoundRobinSelector {
+	return &RoundRobinSelector{}
+}
+
+func (s *RoundRobinSelector) Select(method string, args interface{}) (*Endpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.eps) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	ep := s.eps[s.next%len(s.eps)]
+	s.next++
+	return ep, nil
+}
+
+func (s *RoundRobinSelector) Report(ep *Endpoint, err error) {}
+
+func (s *RoundRobinSelector) Endpoints(eps []*Endpoint) {
+	s.mu.Lock()
+	s.eps = eps
+	s.mu.Unlock()
+}
+
+// RandomSelector picks a uniformly random Endpoint for every call.
+type RandomSelector struct {
+	mu  sync.Mutex
+	eps []*Endpoint
+}
+
+// NewRandomSelector creates a RandomSelector with no Endpoints.
+func NewRandomSelector() *RandomSelector {
+	return &RandomSelector{}
+}
+
+func (s *RandomSelector) Select(method string, args interface{}) (*Endpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.eps) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	return s.eps[rand.Intn(len(s.eps))], nil
+}
+
+func (s *RandomSelector) Report(ep *Endpoint, err error) {}
+
+func (s *RandomSelector) Endpoints(eps []*Endpoint) {
+	s.mu.Lock()
+	s.eps = eps
+	s.mu.Unlock()
+}
+
+// WeightedSelector picks an Endpoint at random, biased by a fixed
+// per-address weight: an address with weight 3 is chosen three times as
+// often as one with weight 1. An address with no entry in weights, or
+// not currently connected, is never selected.
+type WeightedSelector struct {
+	weights map[string]int
+
+	mu  sync.Mutex
+	eps []*Endpoint
+}
+
+// NewWeightedSelector creates a WeightedSelector that distributes calls
+// across addresses in proportion to weights.
+func NewWeightedSelector(weights map[string]int) *WeightedSelector {
+	return &WeightedSelector{weights: weights}
+}
+
+func (s *WeightedSelector) Select(method string, args interface{}) (*Endpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := 0
+	for _, ep := range s.eps {
+		total += s.weights[ep.Addr]
+	}
+	if total == 0 {
+		return nil, ErrNoEndpoints
+	}
+	n := rand.Intn(total)
+	for _, ep := range s.eps {
+		w := s.weights[ep.Addr]
+		if n < w {
+			return ep, nil
+		}
+		n -= w
+	}
+	return nil, ErrNoEndpoints
+}
+
+func (s *WeightedSelector) Report(ep *Endpoint, err error) {}
+
+func (s *WeightedSelector) Endpoints(eps []*Endpoint) {
+	s.mu.Lock()
+	s.eps = eps
+	s.mu.Unlock()
+}
+
+// virtualNodesPerEndpoint is the number of points each Endpoint gets on
+// a HashSelector's ring: more points spread a ring's keys more evenly
+// across Endpoints at the cost of a larger ring to search.
+const virtualNodesPerEndpoint = 100
+
+// HashSelector routes every call for the same key (as computed by
+// keyFunc from the call's method and args) to the same Endpoint, using
+// a consistent-hash ring so that adding or removing an Endpoint remaps
+// only the keys that landed near it rather than reshuffling everything.
+type HashSelector struct {
+	keyFunc func(method string, args interface{}) string
+
+	mu   sync.Mutex
+	ring []ringPoint
+}
+
+type ringPoint struct {
+	hash uint32
+	ep   *Endpoint
+}
+
+// NewHashSelector creates a HashSelector that routes a call to the
+// Endpoint owning the ring position nearest the hash of keyFunc's
+// result.
+func NewHashSelector(keyFunc func(method string, args interface{}) string) *HashSelector {
+	return &HashSelector{keyFunc: keyFunc}
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func (s *HashSelector) Select(method string, args interface{}) (*Endpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.ring) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	h := hashString(s.keyFunc(method, args))
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.ring[i].ep, nil
+}
+
+func (s *HashSelector) Report(ep *Endpoint, err error) {}
+
+func (s *HashSelector) Endpoints(eps []*Endpoint) {
+	ring := make([]ringPoint, 0, len(eps)*virtualNodesPerEndpoint)
+	for _, ep := range eps {
+		for i := 0; i < virtualNodesPerEndpoint; i++ {
+			ring = append(ring, ringPoint{hash: hashString(fmt.Sprintf("%s#%d", ep.Addr, i)), ep: ep})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	s.mu.Lock()
+	s.ring = ring
+	s.mu.Unlock()
+}
+
+// HealthAwareSelector wraps another Selector and skips Endpoints whose
+// last windowSize reported calls were all errors, falling back to the
+// inner Selector's choice anyway once no healthy Endpoint can be found
+// within a bounded number of tries -- an excluded Endpoint is better
+// tried again than abandoned forever.
+type HealthAwareSelector struct {
+	inner      Selector
+	windowSize int
+
+	mu      sync.Mutex
+	history map[string][]bool // per-address outcomes, true == success, most recent last
+}
+
+// NewHealthAwareSelector wraps inner, tracking the last windowSize
+// reported outcomes for each address before excluding it from
+// selection.
+func NewHealthAwareSelector(inner Selector, windowSize int) *HealthAwareSelector {
+	return &HealthAwareSelector{inner: inner, windowSize: windowSize, history: make(map[string][]bool)}
+}
+
+// maxHealthAttempts bounds how many times Select asks the inner
+// Selector for a different Endpoint before giving up and returning
+// whatever it last got, rather than looping forever when every
+// Endpoint is unhealthy.
+const maxHealthAttempts = 5
+
+func (s *HealthAwareSelector) Select(method string, args interface{}) (*Endpoint, error) {
+	var ep *Endpoint
+	var err error
+	for i := 0; i < maxHealthAttempts; i++ {
+		ep, err = s.inner.Select(method, args)
+		if err != nil {
+			return nil, err
+		}
+		if s.healthy(ep) {
+			return ep, nil
+		}
+	}
+	return ep, nil
+}
+
+func (s *HealthAwareSelector) healthy(ep *Endpoint) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hist := s.history[ep.Addr]
+	if len(hist) < s.windowSize {
+		return true
+	}
+	for _, ok := range hist {
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *HealthAwareSelector) Report(ep *Endpoint, err error) {
+	s.inner.Report(ep, err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hist := append(s.history[ep.Addr], err == nil)
+	if len(hist) > s.windowSize {
+		hist = hist[len(hist)-s.windowSize:]
+	}
+	s.history[ep.Addr] = hist
+}
+
+func (s *HealthAwareSelector) Endpoints(eps []*Endpoint) {
+	s.inner.Endpoints(eps)
+}
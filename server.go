@@ -0,0 +1,213 @@
+package duplex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var (
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+	sendStreamType = reflect.TypeOf(SendStream{})
+	channelPtrType = reflect.TypeOf((*Channel)(nil))
+	contextType    = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+// methodMode classifies a registered method by how its arguments flow,
+// mirroring the three call shapes duplex supports.
+type methodMode int
+
+const (
+	// modeUnary: func(Args, *Reply) error -- request/response.
+	modeUnary methodMode = iota
+	// modeStreamOut: func(Args, SendStream) error -- one request, a
+	// stream of replies.
+	modeStreamOut
+	// modeChannel: func(*Channel) error -- full duplex, the handler
+	// drives both sides of the stream itself.
+	modeChannel
+)
+
+type methodType struct {
+	method  reflect.Method
+	argType reflect.Type // unused for modeChannel
+	mode    methodMode
+	// wantsContext is true if method's first argument (after the
+	// receiver) is a context.Context -- invoke then passes the
+	// channel's ctx, which is canceled when the channel finishes for
+	// any reason, including a CANCEL frame from the caller.
+	wantsContext bool
+}
+
+type service struct {
+	name    string
+	rcvr    reflect.Value
+	typ     reflect.Type
+	methods map[string]*methodType
+}
+
+// Register makes the exported methods of rcvr available to peers that
+// Call or Open "Type.Method", the same convention net/rpc uses. rcvr's
+// methods must match one of three shapes: func(Args, *Reply) error,
+// func(Args, SendStream) error, or func(*Channel) error, each optionally
+// preceded by a context.Context parameter.
+func (p *Peer) Register(rcvr interface{}) error {
+	svc := &service{
+		rcvr:    reflect.ValueOf(rcvr),
+		typ:     reflect.TypeOf(rcvr),
+		methods: make(map[string]*methodType),
+	}
+	svc.name = reflect.Indirect(svc.rcvr).Type().Name()
+	if svc.name == "" {
+		return fmt.Errorf("duplex: no service name for type %s", svc.typ)
+	}
+	for i := 0; i < svc.typ.NumMethod(); i++ {
+		method := svc.typ.Method(i)
+		if mt, err := suitableMethod(method); err == nil {
+			svc.methods[method.Name] = mt
+		}
+	}
+	if len(svc.methods) == 0 {
+		return fmt.Errorf("duplex: %s has no suitable methods", svc.name)
+	}
+	p.mu.Lock()
+	p.services[svc.name] = svc
+	p.mu.Unlock()
+	return nil
+}
+
+func suitableMethod(method reflect.Method) (*methodType, error) {
+	if method.PkgPath != "" {
+		return nil, errors.New("duplex: method not exported")
+	}
+	mtype := method.Func.Type()
+	if mtype.NumOut() != 1 || mtype.Out(0) != errorType {
+		return nil, errors.New("duplex: unsuitable method signature")
+	}
+
+	// A leading context.Context is optional and, if present, doesn't
+	// count against the argument shapes below.
+	wantsContext := mtype.NumIn() > 1 && mtype.In(1) == contextType
+	first := 1
+	if wantsContext {
+		first = 2
+	}
+
+	switch mtype.NumIn() - first {
+	case 1: // [ctx,] *Channel
+		if mtype.In(first) == channelPtrType {
+			return &methodType{method: method, mode: modeChannel, wantsContext: wantsContext}, nil
+		}
+	case 2: // [ctx,] Args, *Reply or SendStream
+		argType := mtype.In(first)
+		second := mtype.In(first + 1)
+		if second == sendStreamType {
+			return &methodType{method: method, argType: argType, mode: modeStreamOut, wantsContext: wantsContext}, nil
+		}
+		if second.Kind() == reflect.Ptr {
+			return &methodType{method: method, argType: argType, mode: modeUnary, wantsContext: wantsContext}, nil
+		}
+	}
+	return nil, errors.New("duplex: unsuitable method signature")
+}
+
+func deref(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
+
+// dispatchRequest is handed off from a session's read loop to Peer.Serve
+// when a frameOpen arrives for a new channel.
+type dispatchRequest struct {
+	ch     *Channel
+	method string
+	arg    []byte
+}
+
+// dispatch looks up and invokes the method named by req, routed through
+// the Peer's ServerInterceptor chain (see UseServer). The lookup itself
+// happens in the chain's terminal handler rather than up front, so an
+// interceptor can rewrite the method name (to strip an embedded auth
+// token, say) before the real service/method split ever sees it.
+func (p *Peer) dispatch(req dispatchRequest) {
+	terminal := func(ctx context.Context, method string, ch *Channel) {
+		dot := strings.LastIndex(method, ".")
+		if dot < 0 {
+			ch.sendError(fmt.Errorf("duplex: malformed method name %q", method))
+			return
+		}
+		svcName, methodName := method[:dot], method[dot+1:]
+		p.mu.Lock()
+		svc := p.services[svcName]
+		p.mu.Unlock()
+		if svc == nil {
+			ch.sendError(fmt.Errorf("duplex: unknown service %q", svcName))
+			return
+		}
+		m := svc.methods[methodName]
+		if m == nil {
+			ch.sendError(fmt.Errorf("duplex: unknown method %q", method))
+			return
+		}
+		m.invoke(svc, ch, req.arg)
+	}
+	h := chainServer(p.serverInterceptors, terminal)
+	h(req.ch.ctx, req.method, req.ch)
+}
+
+func (m *methodType) invoke(svc *service, ch *Channel, argPayload []byte) {
+	in := []reflect.Value{svc.rcvr}
+	if m.wantsContext {
+		in = append(in, reflect.ValueOf(ch.ctx))
+	}
+
+	switch m.mode {
+	case modeChannel:
+		ret := m.method.Func.Call(append(in, reflect.ValueOf(ch)))
+		finishCall(ch, ret[0])
+
+	case modeUnary, modeStreamOut:
+		argv := reflect.New(deref(m.argType))
+		if len(argPayload) > 0 {
+			if err := decodeValue(ch.sess.peer.codec, argPayload, argv.Interface()); err != nil {
+				ch.sendError(err)
+				return
+			}
+		}
+		argIn := argv.Elem()
+		if m.argType.Kind() == reflect.Ptr {
+			argIn = argv
+		}
+		in = append(in, argIn)
+
+		if m.mode == modeStreamOut {
+			stream := SendStream{ch: ch}
+			ret := m.method.Func.Call(append(in, reflect.ValueOf(stream)))
+			finishCall(ch, ret[0])
+			return
+		}
+
+		replyv := reflect.New(m.method.Func.Type().In(len(in)).Elem())
+		ret := m.method.Func.Call(append(in, replyv))
+		if errv := ret[0]; !errv.IsNil() {
+			ch.sendError(errv.Interface().(error))
+			return
+		}
+		if err := ch.Send(replyv.Interface()); err != nil {
+			return
+		}
+		ch.sendClose()
+	}
+}
+
+func finishCall(ch *Channel, errv reflect.Value) {
+	if !errv.IsNil() {
+		ch.sendError(errv.Interface().(error))
+		return
+	}
+	ch.sendClose()
+}
@@ -0,0 +1,236 @@
+package duplex
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// sendHello writes the local Codec's name as the first frame on conn.
+// Both sides of a session send one; dialHandshake reads the reply
+// synchronously, while the accepting side reads it as the first frame of
+// its normal readLoop (see recvHello) so that Bind never blocks a new
+// session's visibility on a network round trip.
+func sendHello(conn net.Conn, name string) error {
+	return writeFrame(conn, &frame{typ: frameHello, payload: []byte(name)})
+}
+
+// dialHandshake completes the codec handshake from the dialing side: it
+// sends the local name and waits for the peer's, failing fast if they
+// don't match. This is the "fail fast" half of the contract; the
+// accepting side has no caller to report a mismatch to, so it validates
+// the peer's name asynchronously instead (see recvHello).
+func dialHandshake(conn net.Conn, name string) error {
+	if err := sendHello(conn, name); err != nil {
+		return fmt.Errorf("duplex: handshake: %w", err)
+	}
+	f, err := readFrame(conn)
+	if err != nil {
+		return fmt.Errorf("duplex: handshake: %w", err)
+	}
+	if f.typ != frameHello {
+		return fmt.Errorf("duplex: handshake: expected hello frame, got type %d", f.typ)
+	}
+	if peerName := string(f.payload); peerName != name {
+		return fmt.Errorf("duplex: codec mismatch: local %q, peer %q", name, peerName)
+	}
+	return nil
+}
+
+// recvHello validates the first frame of an accepted session's readLoop:
+// it must be a frameHello naming the same Codec as the local one.
+func recvHello(f *frame, name string) error {
+	if f.typ != frameHello {
+		return fmt.Errorf("duplex: handshake: expected hello frame, got type %d", f.typ)
+	}
+	if peerName := string(f.payload); peerName != name {
+		return fmt.Errorf("duplex: codec mismatch: local %q, peer %q", name, peerName)
+	}
+	return nil
+}
+
+// session is one Peer's end of one physical connection. A connection
+// carries many channels at once, identified by id; ids are allocated by
+// whichever side opens the channel. To avoid the two sides colliding on
+// the same id without negotiation, the dialing side uses odd ids and the
+// accepting side uses even ids.
+type session struct {
+	conn net.Conn
+	peer *Peer
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	nextID   uint64
+	channels map[uint64]*Channel
+	closed   bool
+
+	// capMu/capCond guard flow-control bookkeeping shared by every
+	// channel on this session: each Channel's sendWindow plus the
+	// session-wide pendingTotal cap.
+	capMu           sync.Mutex
+	capCond         *sync.Cond
+	pendingTotal    int
+	maxPendingBytes int
+
+	// expectHello is true for accepted sessions, which still owe their
+	// peer a codec-name check on the first frame of readLoop (the
+	// dialing side already did this check in dialHandshake before the
+	// session existed).
+	expectHello bool
+
+	// pubCh queues incoming framePublish frames for publishLoop, so a
+	// slow Subscribe handler stalls only this session's pub/sub delivery
+	// rather than readLoop itself -- and with it, every unrelated call
+	// multiplexed on the same connection. The queue holds 64 frames; once
+	// it is full, readLoop blocks on the send until publishLoop catches
+	// up. It is never closed -- readLoop
+	// is its only sender, and closing a channel a concurrent goroutine
+	// might still be sending on panics -- publishLoop instead exits on
+	// stopped.
+	pubCh chan *frame
+
+	// stopped is closed once readLoop has returned, telling publishLoop
+	// to exit; see pubCh.
+	stopped chan struct{}
+}
+
+func newSession(conn net.Conn, peer *Peer, dialed bool) *session {
+	s := &session{
+		conn:            conn,
+		peer:            peer,
+		channels:        make(map[uint64]*Channel),
+		maxPendingBytes: peer.maxPendingBytes,
+		expectHello:     !dialed,
+		pubCh:           make(chan *frame, 64),
+		stopped:         make(chan struct{}),
+	}
+	if dialed {
+		s.nextID = 1
+	} else {
+		s.nextID = 0
+	}
+	s.capCond = sync.NewCond(&s.capMu)
+	go s.publishLoop()
+	return s
+}
+
+// publishLoop delivers framePublish frames to local subscribers one at a
+// time and in arrival order, off of readLoop's goroutine.
+func (s *session) publishLoop() {
+	for {
+		select {
+		case f := <-s.pubCh:
+			s.peer.deliverPublish(s, f)
+		case <-s.stopped:
+			return
+		}
+	}
+}
+
+func (s *session) writeFrame(f *frame) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return writeFrame(s.conn, f)
+}
+
+// newLocalChannel allocates a channel id for a call initiated from this
+// side of the session.
+func (s *session) newLocalChannel() *Channel {
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID += 2
+	ch := newChannel(id, s)
+	s.channels[id] = ch
+	s.mu.Unlock()
+	return ch
+}
+
+func (s *session) forget(id uint64) {
+	s.mu.Lock()
+	delete(s.channels, id)
+	s.mu.Unlock()
+}
+
+func (s *session) readLoop() {
+	defer func() {
+		// Tell publishLoop to stop before close() tears anything down:
+		// readLoop is the only goroutine that sends on pubCh, so once
+		// this fires there will never be another send to race against.
+		close(s.stopped)
+		s.close(ErrConnLost)
+	}()
+	if s.expectHello {
+		f, err := readFrame(s.conn)
+		if err != nil {
+			return
+		}
+		if err := recvHello(f, s.peer.codec.Name()); err != nil {
+			return
+		}
+		s.expectHello = false
+	}
+	for {
+		f, err := readFrame(s.conn)
+		if err != nil {
+			return
+		}
+		switch f.typ {
+		case frameOpen:
+			s.handleOpen(f)
+			continue
+		case frameSubscribe:
+			s.peer.addRemoteInterest(s, f.method)
+			continue
+		case frameUnsubscribe:
+			s.peer.removeRemoteInterest(s, f.method)
+			continue
+		case framePublish:
+			s.pubCh <- f
+			continue
+		case framePublishAck:
+			s.peer.ackPublish(s, f.id)
+			continue
+		}
+		s.mu.Lock()
+		ch := s.channels[f.id]
+		s.mu.Unlock()
+		if ch == nil {
+			continue
+		}
+		ch.deliver(f)
+	}
+}
+
+func (s *session) handleOpen(f *frame) {
+	ch := newChannel(f.id, s)
+	s.mu.Lock()
+	s.channels[f.id] = ch
+	s.mu.Unlock()
+	s.peer.openCh <- dispatchRequest{ch: ch, method: f.method, arg: f.payload}
+}
+
+func (s *session) close(err error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	channels := make([]*Channel, 0, len(s.channels))
+	for _, ch := range s.channels {
+		channels = append(channels, ch)
+	}
+	s.mu.Unlock()
+
+	s.conn.Close()
+	// Drop this session from the Peer's pool of endpoints before telling
+	// its channels why they're finishing: a retried call (see WithRetry)
+	// must never be able to pick this session back up just because it
+	// raced dropSession and saw the stale pool first.
+	s.peer.dropSession(s)
+	for _, ch := range channels {
+		ch.finish(err)
+	}
+	s.capCond.Broadcast()
+}